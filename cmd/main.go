@@ -7,46 +7,219 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/NYTimes/gziphandler"
+	"github.com/bestleg/ImagePreviewer/pkg/config"
 	"github.com/bestleg/ImagePreviewer/pkg/logging"
 	lru "github.com/bestleg/ImagePreviewer/pkg/services/cache"
 	transformerPkg "github.com/bestleg/ImagePreviewer/pkg/services/cropper"
 	fetcherPkg "github.com/bestleg/ImagePreviewer/pkg/services/fetcher"
+	"github.com/bestleg/ImagePreviewer/pkg/services/health"
 	"github.com/bestleg/ImagePreviewer/pkg/services/http"
+	"github.com/bestleg/ImagePreviewer/pkg/services/policy"
 	"github.com/bestleg/ImagePreviewer/pkg/services/processor"
+	"github.com/bestleg/ImagePreviewer/pkg/services/signer"
+	"github.com/bestleg/ImagePreviewer/pkg/tracing"
 )
 
 var (
 	appName         = "image-previewer"
 	addr            string
+	adminAddr       string
 	connectTimeout  time.Duration
 	requestTimeout  time.Duration
+	decodeTimeout   time.Duration
+	encodeTimeout   time.Duration
 	shutdownTimeout time.Duration
 	cacheDir        string
 	cacheSize       int
+	hideErrors      bool
+	maxSourceSize   int64
+	maxSourcePixels int
+	maxSourceDim    int
+	maxOutputDim    int
+	allowedNetworks string
+	configPath      string
+	allowOrigins    string
+	denyOrigins     string
+	presetsOnly     bool
+	maxRedirects    int
+	fetchAttempts   int
+	fetchRetryDelay time.Duration
+	breakerFailures int
+	breakerCooldown time.Duration
+	hostLimits      fetcherPkg.HostLimits
+	idleConns       int
+	workers         int
+	workerQueue     int
+	workerWait      time.Duration
+	memoryBudget    int64
+	memoryWait      time.Duration
+	otlpEndpoint    string
+	traceRatio      float64
+	logConfig       logging.Config
+	logOutputs      string
+	logSampleFirst  int
+	logSampleNext   int
+	minFreeDisk     uint64
+	canaryURL       string
+	canaryInterval  time.Duration
 )
 
 func init() {
 	flag.StringVar(&addr, "addr", ":8081", "App addr")
+	flag.StringVar(&adminAddr, "admin-addr", "127.0.0.1:8082",
+		"Addr of admin endpoints like /admin/log-level, keep it private; empty disables them")
 	flag.DurationVar(&connectTimeout, "connect-timeout", 25*time.Second, "Сonnection timeout")
 	flag.DurationVar(&requestTimeout, "request-timeout", 25*time.Second, "Request timeout")
+	flag.DurationVar(&decodeTimeout, "decode-timeout", 10*time.Second, "Source image decoding timeout, 0 disables it")
+	flag.DurationVar(&encodeTimeout, "encode-timeout", 10*time.Second, "Preview encoding timeout, 0 disables it")
 	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "Graceful shutdown timeout")
 	flag.StringVar(&cacheDir, "cache-dir", "", "Path to Cache dir")
 	flag.IntVar(&cacheSize, "cache-size", 5, "Size of cache")
+	flag.Int64Var(&maxSourceSize, "max-source-size", 20<<20, "Maximum origin image size in bytes, 0 disables the limit")
+	flag.IntVar(&maxSourcePixels, "max-source-pixels", 50_000_000, "Maximum origin image pixels, 0 disables the limit")
+	flag.IntVar(&maxSourceDim, "max-source-dimension", 16384, "Maximum origin image side in pixels, 0 disables the limit")
+	flag.IntVar(&maxOutputDim, "max-output-dimension", 4096, "Maximum preview side in pixels, 0 disables the limit")
+	flag.IntVar(&fetchAttempts, "fetch-max-attempts", 3, "Maximum origin request attempts for transient errors")
+	flag.DurationVar(&fetchRetryDelay, "fetch-retry-delay", 100*time.Millisecond, "Base delay of origin request retries")
+	flag.IntVar(&breakerFailures, "breaker-failures", 5,
+		"Consecutive origin failures (5xx, timeouts, connection errors, not 429) opening its circuit breaker, 0 disables the breaker")
+	flag.DurationVar(&breakerCooldown, "breaker-cooldown", 30*time.Second, "Time before an open breaker lets a probe through")
+	flag.IntVar(&hostLimits.MaxConcurrent, "origin-max-concurrency", 16,
+		"Maximum simultaneous fetches per origin host, 0 means unlimited")
+	flag.DurationVar(&hostLimits.QueueTimeout, "origin-queue-timeout", 5*time.Second,
+		"Maximum wait for a per origin fetch slot")
+	flag.Float64Var(&hostLimits.RateLimit, "origin-rate-limit", 0, "Requests per second per origin host, 0 means unlimited")
+	flag.IntVar(&hostLimits.RateBurst, "origin-rate-burst", 10, "Burst of requests per origin host above the rate limit")
+	flag.IntVar(&idleConns, "origin-idle-conns", 8, "Keep-alive connections pooled per origin host")
+	flag.IntVar(&workers, "workers", 0, "Simultaneous image transformations, 0 means GOMAXPROCS")
+	flag.IntVar(&workerQueue, "worker-queue", 64, "Transformations waiting for a free worker before rejecting requests")
+	flag.DurationVar(&workerWait, "worker-queue-timeout", 5*time.Second, "Maximum wait for a free worker")
+	flag.Int64Var(&memoryBudget, "memory-budget", 768<<20,
+		"Memory in bytes all image transformations may use together, 0 disables the limit")
+	flag.DurationVar(&memoryWait, "memory-wait", 5*time.Second, "Maximum wait for free memory budget")
+	flag.IntVar(&maxRedirects, "max-redirects", 5, "Maximum origin redirects to follow, 0 disables following")
+	flag.StringVar(&allowedNetworks, "allowed-networks", "",
+		"Comma separated CIDRs the fetcher may reach despite SSRF protection, e.g. 10.0.0.0/8")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", "",
+		"OTLP/HTTP collector host:port to export traces to, e.g. localhost:4318, tracing is off if empty")
+	flag.Float64Var(&traceRatio, "trace-sample-ratio", 1, "Share of requests traced when the client sent no trace")
+	flag.StringVar(&logConfig.Level, "log-level", envOr("LOG_LEVEL", "info"),
+		"Log level: debug, info, warn or error, LOG_LEVEL by default; changed with PUT /admin/log-level on -admin-addr")
+	flag.StringVar(&logConfig.Encoding, "log-encoding", "console", "Log encoding: console or json")
+	flag.StringVar(&logOutputs, "log-output", "stdout", "Comma separated log destinations: stdout, stderr or file paths")
+	flag.IntVar(&logSampleFirst, "log-access-sample-first", 0,
+		"Access log lines written each second before sampling starts, 0 disables sampling")
+	flag.IntVar(&logSampleNext, "log-access-sample-thereafter", 100,
+		"Once sampling starts, only every Nth access log line of the second is written")
+	flag.Uint64Var(&minFreeDisk, "readiness-min-free-disk", 100<<20,
+		"Free bytes the cache dir file system must have for the service to be ready")
+	flag.StringVar(&canaryURL, "readiness-canary-url", "",
+		"Image fetched by readiness checks, e.g. http://example.com/canary.jpg, not fetched if empty")
+	flag.DurationVar(&canaryInterval, "readiness-canary-interval", 30*time.Second,
+		"Minimum interval between fetches of the readiness canary, results are reused in between")
+	flag.StringVar(&configPath, "config", "", "Path to YAML config file")
+	flag.StringVar(&allowOrigins, "allow-origins", "",
+		"Comma separated origins to allow: example.com, *.example.com, example.com/images/, example.com:8080; without a port only the default one is allowed")
+	flag.StringVar(&denyOrigins, "deny-origins", "", "Comma separated origins to deny, same format as -allow-origins")
+	flag.BoolVar(&presetsOnly, "presets-only", false, "Serve only /preset/<name>/<url> requests")
+	flag.BoolVar(&hideErrors, "hide-error-details", false, "Hide internal error details from clients")
 }
 
 func main() {
-	ctx := context.Background()
 	flag.Parse()
 
-	logger, err := logging.InitLogger()
+	logConfig.OutputPaths = splitList(logOutputs)
+	logConfig.ErrorOutputPaths = logConfig.OutputPaths
+	logger, logLevel, err := logging.InitLogger(logConfig)
 	if err != nil {
 		log.Fatal(fmt.Sprintf("err to init logger %v", err))
 	}
-	fetcher := fetcherPkg.NewFetcher(logger, connectTimeout, requestTimeout)
-	cropper := transformerPkg.NewCropper()
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		logger.Fatalf("failed to load config: %v", err)
+	}
+	logger = logging.Redact(logger, newRedactor(cfg.Redact))
+
+	shutdownTracing, err := tracing.Init(context.Background(), appName, otlpEndpoint, traceRatio)
+	if err != nil {
+		logger.Fatalf("failed to setup tracing: %v", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Errorf("failed to flush traces: %v", err)
+		}
+	}()
+	allowedNets, err := fetcherPkg.ParseNetworks(allowedNetworks)
+	if err != nil {
+		logger.Fatalf("failed to parse allowed networks: %v", err)
+	}
+	originPolicy, err := policy.NewOriginPolicy(
+		append(cfg.Origins.Allow, splitList(allowOrigins)...),
+		append(cfg.Origins.Deny, splitList(denyOrigins)...),
+	)
+	if err != nil {
+		logger.Fatalf("failed to setup origin policy: %v", err)
+	}
+
+	processorOpts := []processor.Option{
+		processor.WithHiddenErrorDetails(hideErrors),
+		processor.WithMaxOutputDimension(maxOutputDim),
+		processor.WithOriginPolicy(originPolicy),
+		processor.WithMemoryBudget(memoryBudget, memoryWait),
+	}
+	presets := make(map[string]transformerPkg.Params, len(cfg.Presets))
+	for name, preset := range cfg.Presets {
+		presets[name], err = transformerPkg.NewParams(
+			preset.Mode, preset.Width, preset.Height, preset.Format, preset.Quality, preset.Filters,
+		)
+		if err != nil {
+			logger.Fatalf("invalid preset %q: %v", name, err)
+		}
+	}
+	processorOpts = append(processorOpts, processor.WithPresets(presets, presetsOnly))
+	if len(cfg.Signature.Keys) > 0 {
+		urlSigner, err := signer.NewSigner(cfg.Signature.Keys)
+		if err != nil {
+			logger.Fatalf("failed to setup url signer: %v", err)
+		}
+		processorOpts = append(processorOpts, processor.WithSigner(urlSigner))
+	}
+
+	headerPolicy, err := newHeaderPolicy(cfg.Headers)
+	if err != nil {
+		logger.Fatalf("failed to setup header policy: %v", err)
+	}
+
+	credentials, err := newCredentialStore(cfg.Credentials)
+	if err != nil {
+		logger.Fatalf("failed to setup origin credentials: %v", err)
+	}
+
+	fetcher := fetcherPkg.NewFetcher(logger, connectTimeout, requestTimeout,
+		fetcherPkg.WithMaxSourceSize(maxSourceSize),
+		fetcherPkg.WithAllowedNetworks(allowedNets),
+		fetcherPkg.WithMaxRedirects(maxRedirects),
+		fetcherPkg.WithOriginPolicy(originPolicy),
+		fetcherPkg.WithHeaderPolicy(headerPolicy),
+		fetcherPkg.WithCredentials(credentials),
+		fetcherPkg.WithRetries(fetchAttempts, fetchRetryDelay),
+		fetcherPkg.WithCircuitBreaker(breakerFailures, breakerCooldown),
+		fetcherPkg.WithHostLimits(hostLimits),
+		fetcherPkg.WithIdleConnsPerHost(idleConns),
+	)
+	cropper := transformerPkg.NewCropper(
+		transformerPkg.WithMaxSourcePixels(maxSourcePixels),
+		transformerPkg.WithMaxSourceDimension(maxSourceDim),
+		transformerPkg.WithMaxOutputDimension(maxOutputDim),
+		transformerPkg.WithDecodeTimeout(decodeTimeout),
+		transformerPkg.WithEncodeTimeout(encodeTimeout),
+	)
 
 	if cacheDir == "" {
 		var err error
@@ -66,10 +239,84 @@ func main() {
 		logger.Fatalf("failed to setup cache %v", err)
 	}
 
-	processor := processor.NewProcessor(cacheDir, logger, fetcher, cropper, cache)
-	handlerWithGz := gziphandler.GzipHandler(processor.ProcessorHandler(ctx))
-	middleWareLoggerHandler := logging.MiddleWareLogger(logger)
-	server := http.NewHTTPServer(addr, shutdownTimeout, middleWareLoggerHandler(handlerWithGz))
+	pool := transformerPkg.NewPool(cropper, workers, workerQueue, workerWait)
+	processor := processor.NewProcessor(cacheDir, logger, fetcher, pool, cache, processorOpts...)
+	handlerWithGz := gziphandler.GzipHandler(processor.ProcessorHandler())
+	middleWareLoggerHandler := logging.MiddleWareLogger(logger, logging.Sampled(logger, logSampleFirst, logSampleNext))
+	server := http.NewHTTPServer(addr, adminAddr, shutdownTimeout, middleWareLoggerHandler(handlerWithGz))
+	server.HandleAdmin("/admin/log-level", logLevel)
+	server.AddReadinessCheck("cache_dir", health.DirWritable(cacheDir))
+	server.AddReadinessCheck("disk_space", health.FreeDiskSpace(cacheDir, minFreeDisk))
+	server.AddReadinessCheck("worker_pool", health.NotSaturated(pool))
+	if canaryURL != "" {
+		server.AddReadinessCheck("canary_origin", health.Cached(health.OriginReachable(fetcher, canaryURL), canaryInterval))
+	}
 
 	server.Run(logger, appName)
 }
+
+func envOr(name, fallback string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+	return fallback
+}
+
+func splitList(list string) []string {
+	if list == "" {
+		return nil
+	}
+	return strings.Split(list, ",")
+}
+
+func newRedactor(cfg config.Redact) *logging.Redactor {
+	headers, params := cfg.Headers, cfg.QueryParams
+	if headers == nil {
+		headers = logging.DefaultRedactedHeaders
+	}
+	if params == nil {
+		params = logging.DefaultRedactedQueryParams
+	}
+	return logging.NewRedactor(headers, params)
+}
+
+func newHeaderPolicy(cfg config.Headers) (*fetcherPkg.HeaderPolicy, error) {
+	forward, set := cfg.Forward, cfg.Set
+	if forward == nil {
+		forward = fetcherPkg.DefaultForwardHeaders
+	}
+	if set == nil {
+		set = fetcherPkg.DefaultSetHeaders
+	}
+	rules := make([]fetcherPkg.HeaderRule, 0, len(cfg.Origins))
+	for _, r := range cfg.Origins {
+		rules = append(rules, fetcherPkg.HeaderRule{Origins: r.Match, Forward: r.Forward, Set: r.Set})
+	}
+	return fetcherPkg.NewHeaderPolicy(forward, set, rules)
+}
+
+func newCredentialStore(cfg []config.Credentials) (*fetcherPkg.CredentialStore, error) {
+	creds := make([]fetcherPkg.Credentials, 0, len(cfg))
+	for _, c := range cfg {
+		cred := fetcherPkg.Credentials{
+			Origins:      c.Match,
+			BearerToken:  c.BearerToken,
+			Headers:      c.Headers,
+			UpgradeHTTPS: c.UpgradeHTTPS,
+		}
+		if c.Basic != nil {
+			cred.Basic = &fetcherPkg.BasicAuth{Username: c.Basic.Username, Password: c.Basic.Password}
+		}
+		if c.SigV4 != nil {
+			cred.SigV4 = &fetcherPkg.SigV4{
+				AccessKeyID:     c.SigV4.AccessKeyID,
+				SecretAccessKey: c.SigV4.SecretAccessKey,
+				SessionToken:    c.SigV4.SessionToken,
+				Region:          c.SigV4.Region,
+				Service:         c.SigV4.Service,
+			}
+		}
+		creds = append(creds, cred)
+	}
+	return fetcherPkg.NewCredentialStore(creds)
+}
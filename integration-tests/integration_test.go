@@ -3,6 +3,7 @@ package integrationtests
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"image"
 	_ "image/jpeg"
 	"io/ioutil"
@@ -16,6 +17,12 @@ import (
 
 const imageType = "image/jpeg"
 
+type errorResponse struct {
+	Code           string `json:"code"`
+	Message        string `json:"message"`
+	UpstreamStatus int    `json:"upstream_status"`
+}
+
 type TestSuite struct {
 	suite.Suite
 	client *http.Client
@@ -75,8 +82,13 @@ func TestBadResize(t *testing.T) {
 	res, body, err := s.doRequest(t, url, "resize", width, height)
 	require.NoError(t, err)
 
-	require.Equal(t, http.StatusBadGateway, res.StatusCode)
-	require.Equal(t, "failed to crop image: jpeg: image is too large to encode\n", string(body))
+	require.Equal(t, http.StatusUnprocessableEntity, res.StatusCode)
+	require.Equal(t, "application/json", res.Header.Get("Content-Type"))
+
+	var errResp errorResponse
+	require.NoError(t, json.Unmarshal(body, &errResp))
+	require.Equal(t, "image_too_large", errResp.Code)
+	require.Equal(t, "requested size 111111x2 exceeds 4096 pixels per side: image is too large", errResp.Message)
 }
 
 func TestServerDoesntExist(t *testing.T) {
@@ -102,7 +114,25 @@ func TestCropNotImage(t *testing.T) {
 	res, _, err := s.doRequest(t, url, "fill", width, height)
 	require.NoError(t, err)
 
-	require.Equal(t, http.StatusBadGateway, res.StatusCode)
+	require.Equal(t, http.StatusUnsupportedMediaType, res.StatusCode)
+}
+
+func TestImageNotFound(t *testing.T) {
+	s := NewTestSuite()
+
+	url := "nginx:80/not_exist.jpg"
+	width, height := 555, 111
+
+	// nolint:bodyclose
+	res, body, err := s.doRequest(t, url, "fill", width, height)
+	require.NoError(t, err)
+
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	var errResp errorResponse
+	require.NoError(t, json.Unmarshal(body, &errResp))
+	require.Equal(t, "origin_not_found", errResp.Code)
+	require.Equal(t, http.StatusNotFound, errResp.UpstreamStatus)
 }
 
 func TestFillFromCache(t *testing.T) {
@@ -0,0 +1,103 @@
+package config
+
+import (
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Config holds settings which are too structured for command line flags.
+type Config struct {
+	Origins     Origins           `yaml:"origins"`
+	Signature   Signature         `yaml:"signature"`
+	Presets     map[string]Preset `yaml:"presets"`
+	Headers     Headers           `yaml:"headers"`
+	Credentials []Credentials     `yaml:"credentials"`
+	Redact      Redact            `yaml:"redact"`
+}
+
+// Origins lists origin patterns the service may or may not fetch images from.
+type Origins struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// Signature holds hex encoded HMAC keys, the first one signs new URLs.
+// Signing is disabled when no keys are set.
+type Signature struct {
+	Keys []string `yaml:"keys"`
+}
+
+// Preset is a named transformation served at /preset/<name>/<url>.
+type Preset struct {
+	Mode    string   `yaml:"mode"`
+	Width   int      `yaml:"width"`
+	Height  int      `yaml:"height"`
+	Format  string   `yaml:"format"`
+	Quality int      `yaml:"quality"`
+	Filters []string `yaml:"filters"`
+}
+
+// Headers configures which client headers reach origins. Nil lists fall
+// back to the fetcher defaults, an empty list disables them.
+type Headers struct {
+	Forward []string          `yaml:"forward"`
+	Set     map[string]string `yaml:"set"`
+	Origins []HeaderRule      `yaml:"origins"`
+}
+
+// Redact lists header names and URL query parameters masked in logs.
+// Nil lists fall back to the logging defaults, an empty list disables them.
+type Redact struct {
+	Headers     []string `yaml:"headers"`
+	QueryParams []string `yaml:"query_params"`
+}
+
+// HeaderRule extends Headers for origins matching any of Match patterns.
+type HeaderRule struct {
+	Match   []string          `yaml:"match"`
+	Forward []string          `yaml:"forward"`
+	Set     map[string]string `yaml:"set"`
+}
+
+// Credentials authenticate requests to origins matching any of Match patterns.
+type Credentials struct {
+	Match       []string          `yaml:"match"`
+	Basic       *BasicAuth        `yaml:"basic"`
+	BearerToken string            `yaml:"bearer_token"`
+	Headers     map[string]string `yaml:"headers"`
+	SigV4       *SigV4            `yaml:"sigv4"`
+	// UpgradeHTTPS fetches matching http origins over https, credentials
+	// other than SigV4 are never sent over plain http.
+	UpgradeHTTPS bool `yaml:"upgrade_https"`
+}
+
+type BasicAuth struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+type SigV4 struct {
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+	SessionToken    string `yaml:"session_token"`
+	Region          string `yaml:"region"`
+	Service         string `yaml:"service"`
+}
+
+// Load reads the YAML config file, an empty path yields an empty config.
+func Load(path string) (*Config, error) {
+	cfg := &Config{}
+	if path == "" {
+		return cfg, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read config")
+	}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, errors.Wrap(err, "failed to parse config")
+	}
+	return cfg, nil
+}
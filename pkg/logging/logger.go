@@ -5,13 +5,33 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
-func InitLogger() (*zap.SugaredLogger, error) {
-	var logger *zap.Logger
-	var sugarLogger *zap.SugaredLogger
+// Config describes how the service logs.
+type Config struct {
+	// Level is the minimal level logged: debug, info, warn or error.
+	Level string
+	// Encoding is either console or json.
+	Encoding string
+	// OutputPaths are files or stdout/stderr log lines are written to.
+	OutputPaths []string
+	// ErrorOutputPaths receive internal errors of the logger.
+	ErrorOutputPaths []string
+}
+
+// InitLogger builds the logger described by cfg. The returned level may be
+// changed at runtime, it serves GET and PUT requests for that over HTTP.
+func InitLogger(cfg Config) (*zap.SugaredLogger, zap.AtomicLevel, error) {
+	level := zap.NewAtomicLevel()
+	if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+		return nil, level, errors.Wrapf(err, "invalid log level %q", cfg.Level)
+	}
+	if cfg.Encoding != "console" && cfg.Encoding != "json" {
+		return nil, level, errors.Errorf("invalid log encoding %q, want console or json", cfg.Encoding)
+	}
 
 	encoderConfig := zapcore.EncoderConfig{
 		TimeKey:        "timestamp",
@@ -28,33 +48,47 @@ func InitLogger() (*zap.SugaredLogger, error) {
 	}
 
 	config := zap.Config{
-		// todo : в конфиг можно выкинуть
-		Level:            zap.NewAtomicLevelAt(zapcore.DebugLevel),
+		Level:            level,
 		Development:      false,
-		Encoding:         "console",
+		Encoding:         cfg.Encoding,
 		EncoderConfig:    encoderConfig,
-		OutputPaths:      []string{"stdout"},
-		ErrorOutputPaths: []string{"stdout"},
+		OutputPaths:      cfg.OutputPaths,
+		ErrorOutputPaths: cfg.ErrorOutputPaths,
 	}
 
-	// Can construct a logger
 	logger, err := config.Build()
 	if err != nil {
-		return nil, err
+		return nil, level, err
 	}
+	return logger.Sugar(), level, nil
+}
 
-	// The then Sugarlogger
-	sugarLogger = logger.Sugar()
-	return sugarLogger, nil
+// Sampled returns a logger which, for every message, writes the first entries
+// logged each second and then only every thereafter-th one. It is meant for
+// high volume logs like the access log, first <= 0 disables sampling.
+func Sampled(logger *zap.SugaredLogger, first, thereafter int) *zap.SugaredLogger {
+	if first <= 0 {
+		return logger
+	}
+	return logger.Desugar().WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return zapcore.NewSamplerWithOptions(core, time.Second, first, thereafter)
+	})).Sugar()
 }
 
-// MiddleWareLogger middleware setup logger and logs all requests.
-func MiddleWareLogger(logger *zap.SugaredLogger) func(http.Handler) http.Handler {
+// MiddleWareLogger middleware setup logger and logs all requests to accessLogger.
+// Every request gets an ID, taken from the X-Request-ID header or generated,
+// which is returned to the client and added to all log lines of the request.
+func MiddleWareLogger(logger, accessLogger *zap.SugaredLogger) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			start := time.Now()
-			next.ServeHTTP(w, r)
-			logger.Infow("http request handled",
+			id := requestID(r.Header.Get(RequestIDHeader))
+			w.Header().Set(RequestIDHeader, id)
+			ctx := WithLogger(WithRequestID(r.Context(), id), logger.With("request_id", id))
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+			accessLogger.Infow("http request handled",
+				"request_id", id,
 				"request", fmt.Sprintf("%s %s %s", r.Method, r.RequestURI, r.Proto),
 				"request_method", r.Method,
 				"request_uri", r.RequestURI,
@@ -0,0 +1,85 @@
+package logging
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestMiddleWareLoggerRequestID(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	var seen string
+	logger := zap.New(core).Sugar()
+	handler := MiddleWareLogger(logger, logger)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestID(r.Context())
+		FromContext(r.Context(), nil).Info("inside handler")
+	}))
+
+	tests := []struct {
+		name string
+		sent string
+		kept bool
+	}{
+		{"accepted", "req-1.a_B", true},
+		{"generated", "", false},
+		{"unsafe", "req 1\nforged", false},
+		{"too long", strings.Repeat("a", maxRequestIDLength+1), false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/fill/1/1/host/img.jpg", nil)
+		if tt.sent != "" {
+			r.Header.Set(RequestIDHeader, tt.sent)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		id := w.Header().Get(RequestIDHeader)
+		require.True(t, validRequestID(id), tt.name)
+		require.Equal(t, id, seen, tt.name)
+		if tt.kept {
+			require.Equal(t, tt.sent, id, tt.name)
+		} else {
+			require.NotEqual(t, tt.sent, id, tt.name)
+		}
+
+		entries := logs.TakeAll()
+		require.Len(t, entries, 2, tt.name)
+		for _, e := range entries {
+			require.Equal(t, id, e.ContextMap()["request_id"], tt.name)
+		}
+	}
+}
+
+func TestInitLogger(t *testing.T) {
+	cfg := Config{Level: "warn", Encoding: "json", OutputPaths: []string{"stderr"}, ErrorOutputPaths: []string{"stderr"}}
+	logger, level, err := InitLogger(cfg)
+	require.NoError(t, err)
+	require.False(t, logger.Desugar().Core().Enabled(zap.InfoLevel))
+
+	level.SetLevel(zap.DebugLevel)
+	require.True(t, logger.Desugar().Core().Enabled(zap.DebugLevel), "level is changed at runtime")
+
+	_, _, err = InitLogger(Config{Level: "verbose", Encoding: "json"})
+	require.Error(t, err)
+	_, _, err = InitLogger(Config{Level: "info", Encoding: "xml"})
+	require.Error(t, err)
+}
+
+func TestSampled(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	logger := zap.New(core).Sugar()
+
+	sampled := Sampled(logger, 2, 5)
+	for i := 0; i < 12; i++ {
+		sampled.Info("http request handled")
+	}
+	logger.Info("not sampled")
+	require.Equal(t, 2+2+1, logs.Len(), "first 2, then the 5th and 10th of the rest")
+
+	require.Same(t, logger, Sampled(logger, 0, 5))
+}
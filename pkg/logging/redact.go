@@ -0,0 +1,156 @@
+package logging
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// redactedValue replaces masked header values and query parameters.
+const redactedValue = "REDACTED"
+
+var (
+	// DefaultRedactedHeaders carry credentials of clients or origins.
+	DefaultRedactedHeaders = []string{
+		"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key", "X-Amz-Security-Token",
+	}
+	// DefaultRedactedQueryParams carry tokens of signed or pre-authorized URLs.
+	DefaultRedactedQueryParams = []string{
+		"token", "access_token", "signature", "sig", "key", "api_key",
+		"X-Amz-Signature", "X-Amz-Credential", "X-Amz-Security-Token",
+	}
+)
+
+// urlPattern finds absolute URLs inside log messages, e.g. in net/http errors.
+var urlPattern = regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.-]*://[^\s"'<>]+`)
+
+// requestURIPattern finds request URIs with a query inside text, e.g. in the
+// request line "GET /fill/1/1/example.com/img.jpg?token=abc HTTP/1.1".
+var requestURIPattern = regexp.MustCompile(`(?:^|\s)/[^\s"'<>]*\?[^\s"'<>]*`)
+
+// Redactor masks sensitive header values and URL query parameters.
+type Redactor struct {
+	headers map[string]struct{}
+	params  map[string]struct{}
+}
+
+// NewRedactor masks the given header names and query parameters, both case-insensitively.
+func NewRedactor(headers, params []string) *Redactor {
+	r := &Redactor{headers: make(map[string]struct{}), params: make(map[string]struct{})}
+	for _, h := range headers {
+		r.headers[http.CanonicalHeaderKey(h)] = struct{}{}
+	}
+	for _, p := range params {
+		r.params[strings.ToLower(p)] = struct{}{}
+	}
+	return r
+}
+
+// Header returns a copy of header with values of sensitive headers masked.
+func (r *Redactor) Header(header http.Header) http.Header {
+	redacted := make(http.Header, len(header))
+	for name, values := range header {
+		if _, ok := r.headers[http.CanonicalHeaderKey(name)]; ok {
+			values = []string{redactedValue}
+		}
+		redacted[name] = values
+	}
+	return redacted
+}
+
+// URL masks sensitive query parameters and the password of rawURL,
+// keeping the order and encoding of other parameters.
+func (r *Redactor) URL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redactedValue)
+	}
+	if u.RawQuery != "" {
+		pairs := strings.Split(u.RawQuery, "&")
+		for i, pair := range pairs {
+			name := strings.SplitN(pair, "=", 2)[0]
+			if unescaped, err := url.QueryUnescape(name); err == nil {
+				name = unescaped
+			}
+			if _, ok := r.params[strings.ToLower(name)]; ok {
+				pairs[i] = url.QueryEscape(name) + "=" + redactedValue
+			}
+		}
+		u.RawQuery = strings.Join(pairs, "&")
+	}
+	return u.String()
+}
+
+// Text masks URLs found in free text. Text starting with a slash is taken
+// for a request URI as a whole, other request URIs are found between spaces.
+func (r *Redactor) Text(text string) string {
+	if strings.HasPrefix(text, "/") && strings.Contains(text, "?") {
+		return r.URL(text)
+	}
+	if strings.Contains(text, "?") {
+		text = requestURIPattern.ReplaceAllStringFunc(text, func(match string) string {
+			i := strings.Index(match, "/")
+			return match[:i] + r.URL(match[i:])
+		})
+	}
+	if !strings.Contains(text, "://") {
+		return text
+	}
+	return urlPattern.ReplaceAllStringFunc(text, r.URL)
+}
+
+// Redact returns a logger masking sensitive data in messages and fields of
+// every entry, including ones of loggers derived from it.
+func Redact(logger *zap.SugaredLogger, r *Redactor) *zap.SugaredLogger {
+	return logger.Desugar().WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return &redactingCore{Core: core, redactor: r}
+	})).Sugar()
+}
+
+type redactingCore struct {
+	zapcore.Core
+	redactor *Redactor
+}
+
+func (c *redactingCore) With(fields []zapcore.Field) zapcore.Core {
+	return &redactingCore{Core: c.Core.With(c.fields(fields)), redactor: c.redactor}
+}
+
+func (c *redactingCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+func (c *redactingCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	entry.Message = c.redactor.Text(entry.Message)
+	return c.Core.Write(entry, c.fields(fields))
+}
+
+func (c *redactingCore) fields(fields []zapcore.Field) []zapcore.Field {
+	redacted := make([]zapcore.Field, len(fields))
+	for i, f := range fields {
+		switch {
+		case f.Type == zapcore.StringType:
+			f.String = c.redactor.Text(f.String)
+		case f.Type == zapcore.ErrorType:
+			if err, ok := f.Interface.(error); ok {
+				f = zap.String(f.Key, c.redactor.Text(err.Error()))
+			}
+		default:
+			if header, ok := f.Interface.(http.Header); ok {
+				f = zap.Any(f.Key, c.redactor.Header(header))
+			}
+		}
+		redacted[i] = f
+	}
+	return redacted
+}
@@ -49,6 +49,7 @@ func (l *lruCache) Set(key Key, value interface{}) bool {
 		out := l.queue.Back()
 		l.queue.Remove(out)
 		delete(l.items, Key(out.Value.(cacheItem).key))
+		cacheEvictions.Inc()
 	}
 
 	return false
@@ -60,9 +61,11 @@ func (l *lruCache) Get(key Key) (interface{}, bool) {
 
 	item, ok := l.items[key]
 	if !ok {
+		cacheMisses.Inc()
 		return nil, false
 	}
 
+	cacheHits.Inc()
 	l.queue.MoveToFront(item)
 
 	return item.Value.(cacheItem).value, true
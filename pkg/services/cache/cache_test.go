@@ -7,6 +7,7 @@ import (
 	"sync"
 	"testing"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
 )
 
@@ -74,6 +75,21 @@ func TestCache(t *testing.T) {
 	})
 }
 
+func TestCacheMetrics(t *testing.T) {
+	hits, misses, evictions := testutil.ToFloat64(cacheHits), testutil.ToFloat64(cacheMisses),
+		testutil.ToFloat64(cacheEvictions)
+	c := NewCache(1)
+
+	c.Set("aaa", 100)
+	c.Get("aaa")
+	c.Set("bbb", 200)
+	c.Get("aaa")
+
+	require.Equal(t, hits+1, testutil.ToFloat64(cacheHits))
+	require.Equal(t, misses+1, testutil.ToFloat64(cacheMisses))
+	require.Equal(t, evictions+1, testutil.ToFloat64(cacheEvictions))
+}
+
 func TestCacheMultithreading(t *testing.T) {
 	t.Skip() // Remove me if task with asterisk completed.
 
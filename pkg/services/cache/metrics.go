@@ -0,0 +1,27 @@
+package cache
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	cacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "image_previewer",
+		Subsystem: "cache",
+		Name:      "hits_total",
+		Help:      "Cache lookups that found the key.",
+	})
+	cacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "image_previewer",
+		Subsystem: "cache",
+		Name:      "misses_total",
+		Help:      "Cache lookups that didn't find the key.",
+	})
+	cacheEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "image_previewer",
+		Subsystem: "cache",
+		Name:      "evictions_total",
+		Help:      "Items removed from the cache to free room for new ones.",
+	})
+)
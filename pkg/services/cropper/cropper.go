@@ -2,38 +2,313 @@ package cropper
 
 import (
 	"bytes"
+	"context"
+	"image"
+	"image/color"
 	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"time"
 
 	"github.com/bestleg/ImagePreviewer/pkg/utils"
 	"github.com/disintegration/imaging"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
 )
 
 type Transformer interface {
-	Crop(img []byte, width, height int, cropFormat uint8) ([]byte, error)
+	Crop(ctx context.Context, img []byte, params Params) ([]byte, error)
 }
 
-type Cropper struct{}
+// tracerName identifies spans of the cropper. The tracer is looked up on use, tracers
+// created before the provider is set would keep delegating to the first one set.
+const tracerName = "github.com/bestleg/ImagePreviewer/pkg/services/cropper"
 
-func NewCropper() *Cropper {
-	return &Cropper{}
+// maxJPEGDimension is the largest side image/jpeg is able to encode.
+const maxJPEGDimension = 1<<16 - 1
+
+type Cropper struct {
+	maxSourcePixels    int
+	maxSourceDimension int
+	maxOutputDimension int
+	decodeTimeout      time.Duration
+	encodeTimeout      time.Duration
+}
+
+// Option configures optional Cropper behavior.
+type Option func(*Cropper)
+
+// WithMaxSourcePixels limits width*height of source images, zero disables the limit.
+func WithMaxSourcePixels(pixels int) Option {
+	return func(t *Cropper) {
+		t.maxSourcePixels = pixels
+	}
+}
+
+// WithMaxSourceDimension limits each side of source images, zero disables the limit.
+func WithMaxSourceDimension(dimension int) Option {
+	return func(t *Cropper) {
+		t.maxSourceDimension = dimension
+	}
+}
+
+// WithMaxOutputDimension limits each side of the preview, including a side
+// derived from the aspect ratio of the source, zero disables the limit.
+func WithMaxOutputDimension(dimension int) Option {
+	return func(t *Cropper) {
+		t.maxOutputDimension = dimension
+	}
 }
 
-func (t *Cropper) Crop(img []byte, width, height int, cropFormat uint8) ([]byte, error) {
-	src, err := imaging.Decode(bytes.NewReader(img))
+// WithDecodeTimeout bounds decoding of the source image, zero disables the limit.
+func WithDecodeTimeout(timeout time.Duration) Option {
+	return func(t *Cropper) {
+		t.decodeTimeout = timeout
+	}
+}
+
+// WithEncodeTimeout bounds encoding of the preview, zero disables the limit.
+func WithEncodeTimeout(timeout time.Duration) Option {
+	return func(t *Cropper) {
+		t.encodeTimeout = timeout
+	}
+}
+
+func NewCropper(opts ...Option) *Cropper {
+	t := &Cropper{}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+// Crop decodes img, transforms it according to params and encodes the preview.
+// Decoding and encoding stop as soon as ctx is done or their stage timeout passes.
+func (t *Cropper) Crop(ctx context.Context, img []byte, params Params) ([]byte, error) {
+	config, err := t.checkSource(img)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := outputSize(config, params, t.maxOutputDimension); err != nil {
+		return nil, err
+	}
+	var src image.Image
+	err = runStage(ctx, "decode", func() (err error) {
+		src, err = t.decode(ctx, img)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = runStage(ctx, "transform", func() (err error) {
+		src, err = transform(ctx, src, params)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-	switch cropFormat {
+	var preview []byte
+	err = runStage(ctx, "encode", func() (err error) {
+		preview, err = t.encode(ctx, src, params)
+		return err
+	})
+	return preview, err
+}
+
+func (t *Cropper) decode(ctx context.Context, img []byte) (image.Image, error) {
+	ctx, cancel := withStageTimeout(ctx, t.decodeTimeout)
+	defer cancel()
+	src, err := imaging.Decode(&contextReader{ctx: ctx, r: bytes.NewReader(img)})
+	if err := stageError(ctx, "decode"); err != nil {
+		return nil, err
+	}
+	if err != nil {
+		return nil, utils.WithKind(utils.ErrDecodeImage, err)
+	}
+	return src, nil
+}
+
+func transform(ctx context.Context, src image.Image, params Params) (image.Image, error) {
+	switch params.CropFormat {
 	case utils.Fill:
-		src = imaging.Fill(src, width, height, imaging.Center, imaging.Lanczos)
+		src = imaging.Fill(src, params.Width, params.Height, imaging.Center, imaging.Lanczos)
 	case utils.Resize:
-		src = imaging.Resize(src, width, height, imaging.Lanczos)
+		src = imaging.Resize(src, params.Width, params.Height, imaging.Lanczos)
 	default:
-		return nil, errors.New("failed to take crop format")
+		return nil, utils.ErrNotSupportedCropFormat
+	}
+	for _, f := range params.Filters {
+		src = f.apply(src)
+	}
+	// Resampling can't be interrupted, so there is no point encoding for a gone client.
+	if err := stageError(ctx, "transform"); err != nil {
+		return nil, err
 	}
+	return src, nil
+}
 
+func (t *Cropper) encode(ctx context.Context, src image.Image, params Params) ([]byte, error) {
+	ctx, cancel := withStageTimeout(ctx, t.encodeTimeout)
+	defer cancel()
 	var buff bytes.Buffer
-	err = jpeg.Encode(&buff, src, nil)
-	return buff.Bytes(), err
+	err := encode(&contextWriter{ctx: ctx, w: &buff}, src, params)
+	if err := stageError(ctx, "encode"); err != nil {
+		return nil, err
+	}
+	if err != nil {
+		return nil, utils.WithKind(utils.ErrEncodeImage, err)
+	}
+	return buff.Bytes(), nil
+}
+
+func encode(w io.Writer, img image.Image, params Params) error {
+	if params.Format == utils.FormatPNG {
+		return png.Encode(w, img)
+	}
+	var options *jpeg.Options
+	if params.Quality > 0 {
+		options = &jpeg.Options{Quality: params.Quality}
+	}
+	return jpeg.Encode(w, img, options)
+}
+
+// checkSource reads only the image header and rejects images whose declared
+// size exceeds the limits, before the full decode allocates pixel memory.
+func (t *Cropper) checkSource(img []byte) (image.Config, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(img))
+	if err != nil {
+		return image.Config{}, utils.WithKind(utils.ErrDecodeImage, err)
+	}
+	if t.maxSourceDimension > 0 && (config.Width > t.maxSourceDimension || config.Height > t.maxSourceDimension) {
+		return image.Config{}, errors.Wrapf(utils.ErrSourceTooLarge, "source size %dx%d exceeds %d pixels per side",
+			config.Width, config.Height, t.maxSourceDimension)
+	}
+	if t.maxSourcePixels > 0 && int64(config.Width)*int64(config.Height) > int64(t.maxSourcePixels) {
+		return image.Config{}, errors.Wrapf(utils.ErrSourceTooLarge, "source size %dx%d exceeds %d pixels",
+			config.Width, config.Height, t.maxSourcePixels)
+	}
+	return config, nil
+}
+
+// outputSize returns the size of the preview of a source described by config,
+// deriving a zero side of a resize like imaging.Resize does. It rejects sizes
+// exceeding maxDimension per side, zero means only the limit of the encoder.
+func outputSize(config image.Config, params Params, maxDimension int) (int, int, error) {
+	width, height := float64(params.Width), float64(params.Height)
+	if width == 0 && config.Height > 0 {
+		width = math.Max(1, math.Floor(height*float64(config.Width)/float64(config.Height)+0.5))
+	}
+	if height == 0 && config.Width > 0 {
+		height = math.Max(1, math.Floor(width*float64(config.Height)/float64(config.Width)+0.5))
+	}
+	if maxDimension <= 0 || maxDimension > maxJPEGDimension {
+		maxDimension = maxJPEGDimension
+	}
+	if width > float64(maxDimension) || height > float64(maxDimension) {
+		return 0, 0, errors.Wrapf(utils.ErrImageTooLarge, "preview size %.0fx%.0f exceeds %d pixels per side",
+			width, height, maxDimension)
+	}
+	return int(width), int(height), nil
+}
+
+// runStage traces and times a step of the transformation.
+func runStage(ctx context.Context, name string, step func() error) error {
+	_, span := otel.Tracer(tracerName).Start(ctx, name)
+	defer span.End()
+	start := time.Now()
+	err := step()
+	stageDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+func withStageTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// stageError reports why the stage context is done, a passed deadline
+// is a processing timeout while cancellation is returned as is.
+func stageError(ctx context.Context, stage string) error {
+	err := ctx.Err()
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errors.Wrapf(utils.WithKind(utils.ErrProcessingTimeout, err), "%s stage", stage)
+	}
+	return errors.Wrapf(err, "%s stage", stage)
+}
+
+// contextReader fails reads once ctx is done, which aborts decoders
+// between the chunks they consume.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// contextWriter fails writes once ctx is done, which aborts encoders
+// between the chunks they produce.
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w *contextWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+// nrgbaBytesPerPixel is the size of a pixel of the working copy imaging makes.
+const nrgbaBytesPerPixel = 4
+
+// EstimateMemory reads only the image header and estimates the bytes Crop
+// allocates for img: the decoded source, its working copy and the preview.
+// Previews exceeding maxDimension per side are rejected like Crop does.
+func EstimateMemory(img []byte, params Params, maxDimension int) (int64, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(img))
+	if err != nil {
+		return 0, utils.WithKind(utils.ErrDecodeImage, err)
+	}
+	width, height, err := outputSize(config, params, maxDimension)
+	if err != nil {
+		return 0, err
+	}
+	source := int64(config.Width) * int64(config.Height)
+	preview := int64(width) * int64(height)
+	return source*(bytesPerPixel(config.ColorModel)+nrgbaBytesPerPixel) + preview*nrgbaBytesPerPixel, nil
+}
+
+func bytesPerPixel(model color.Model) int64 {
+	switch model {
+	case color.GrayModel, color.AlphaModel:
+		return 1
+	case color.Gray16Model, color.Alpha16Model:
+		return 2
+	case color.YCbCrModel:
+		// Chroma subsampling makes it less, 4:4:4 is the worst case.
+		return 3
+	case color.RGBA64Model, color.NRGBA64Model:
+		return 8
+	}
+	if _, ok := model.(color.Palette); ok {
+		return 1
+	}
+	return 4
 }
@@ -0,0 +1,153 @@
+package cropper
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"testing"
+	"time"
+
+	"github.com/bestleg/ImagePreviewer/pkg/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func encodePNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var buff bytes.Buffer
+	require.NoError(t, png.Encode(&buff, image.NewGray(image.Rect(0, 0, width, height))))
+	return buff.Bytes()
+}
+
+func TestCrop(t *testing.T) {
+	img := encodePNG(t, 400, 300)
+
+	t.Run("fill", func(t *testing.T) {
+		out, err := NewCropper().Crop(context.Background(), img, Params{Width: 100, Height: 50, CropFormat: utils.Fill})
+		require.NoError(t, err)
+		config, format, err := image.DecodeConfig(bytes.NewReader(out))
+		require.NoError(t, err)
+		require.Equal(t, "jpeg", format)
+		require.Equal(t, 100, config.Width)
+		require.Equal(t, 50, config.Height)
+	})
+
+	t.Run("resize with one side zero", func(t *testing.T) {
+		params, err := NewParams("resize", 40, 0, "", 0, nil)
+		require.NoError(t, err)
+		out, err := NewCropper().Crop(context.Background(), img, params)
+		require.NoError(t, err)
+		config, _, err := image.DecodeConfig(bytes.NewReader(out))
+		require.NoError(t, err)
+		require.Equal(t, 40, config.Width)
+		require.Equal(t, 30, config.Height)
+	})
+
+	t.Run("derived side exceeds limit", func(t *testing.T) {
+		params, err := NewParams("resize", 0, 1000, "", 0, nil)
+		require.NoError(t, err)
+		_, err = NewCropper(WithMaxOutputDimension(4096)).Crop(context.Background(), encodePNG(t, 1000, 100), params)
+		require.ErrorIs(t, err, utils.ErrImageTooLarge)
+	})
+
+	t.Run("not an image", func(t *testing.T) {
+		params := Params{Width: 100, Height: 50, CropFormat: utils.Fill}
+		_, err := NewCropper().Crop(context.Background(), []byte("text"), params)
+		require.ErrorIs(t, err, utils.ErrDecodeImage)
+	})
+
+	t.Run("too large output", func(t *testing.T) {
+		_, err := NewCropper().Crop(context.Background(), img, Params{Width: 1 << 16, Height: 50, CropFormat: utils.Resize})
+		require.ErrorIs(t, err, utils.ErrImageTooLarge)
+	})
+}
+
+func TestCropSourceLimits(t *testing.T) {
+	img := encodePNG(t, 400, 300)
+	params := Params{Width: 10, Height: 10, CropFormat: utils.Fill}
+	ctx := context.Background()
+
+	_, err := NewCropper(WithMaxSourceDimension(399)).Crop(ctx, img, params)
+	require.ErrorIs(t, err, utils.ErrSourceTooLarge)
+
+	_, err = NewCropper(WithMaxSourcePixels(400*300-1)).Crop(ctx, img, params)
+	require.ErrorIs(t, err, utils.ErrSourceTooLarge)
+
+	_, err = NewCropper(WithMaxSourceDimension(400), WithMaxSourcePixels(400*300)).Crop(ctx, img, params)
+	require.NoError(t, err)
+}
+
+func TestCropCancellation(t *testing.T) {
+	img := encodePNG(t, 400, 300)
+	params := Params{Width: 10, Height: 10, CropFormat: utils.Fill}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := NewCropper().Crop(ctx, img, params)
+	require.ErrorIs(t, err, context.Canceled)
+	require.NotErrorIs(t, err, utils.ErrDecodeImage)
+
+	_, err = NewCropper(WithDecodeTimeout(time.Nanosecond)).Crop(context.Background(), img, params)
+	require.ErrorIs(t, err, utils.ErrProcessingTimeout)
+
+	_, err = NewCropper(WithEncodeTimeout(time.Nanosecond)).Crop(context.Background(), img, params)
+	require.ErrorIs(t, err, utils.ErrProcessingTimeout)
+
+	_, err = NewCropper(WithDecodeTimeout(time.Minute), WithEncodeTimeout(time.Minute)).Crop(context.Background(), img, params)
+	require.NoError(t, err)
+}
+
+func TestEstimateMemory(t *testing.T) {
+	need, err := EstimateMemory(encodePNG(t, 400, 300), Params{Width: 10, Height: 20}, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(400*300*(1+4)+10*20*4), need)
+
+	need, err = EstimateMemory(encodePNG(t, 400, 300), Params{Width: 40}, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(400*300*(1+4)+40*30*4), need)
+
+	_, err = EstimateMemory(encodePNG(t, 1000, 1), Params{Height: 100}, 4096)
+	require.ErrorIs(t, err, utils.ErrImageTooLarge, "derived width exceeds the limit")
+
+	_, err = EstimateMemory([]byte("text"), Params{Width: 10, Height: 20}, 0)
+	require.ErrorIs(t, err, utils.ErrDecodeImage)
+}
+
+func TestCropPresetParams(t *testing.T) {
+	img := encodePNG(t, 400, 300)
+
+	params, err := NewParams("resize", 40, 30, utils.FormatPNG, 0, []string{"grayscale", "sharpen:0.5"})
+	require.NoError(t, err)
+	out, err := NewCropper().Crop(context.Background(), img, params)
+	require.NoError(t, err)
+	config, format, err := image.DecodeConfig(bytes.NewReader(out))
+	require.NoError(t, err)
+	require.Equal(t, "png", format)
+	require.Equal(t, 40, config.Width)
+	require.Equal(t, "image/png", params.ContentType())
+
+	params, err = NewParams("fill", 40, 30, "", 50, nil)
+	require.NoError(t, err)
+	_, err = NewCropper().Crop(context.Background(), img, params)
+	require.NoError(t, err)
+	require.Equal(t, "image/jpeg", params.ContentType())
+}
+
+func TestNewParamsInvalid(t *testing.T) {
+	_, err := NewParams("stretch", 10, 10, "", 0, nil)
+	require.ErrorIs(t, err, utils.ErrNotSupportedCropFormat)
+	_, err = NewParams("fill", 0, 10, "", 0, nil)
+	require.ErrorIs(t, err, utils.ErrInvalidSize)
+	_, err = NewParams("resize", 0, 0, "", 0, nil)
+	require.ErrorIs(t, err, utils.ErrInvalidSize)
+	_, err = NewParams("resize", -1, 10, "", 0, nil)
+	require.ErrorIs(t, err, utils.ErrInvalidSize)
+	_, err = NewParams("fill", 10, 10, "gif", 0, nil)
+	require.Error(t, err)
+	_, err = NewParams("fill", 10, 10, "", 101, nil)
+	require.Error(t, err)
+	for _, f := range []string{"sepia", "blur", "blur:x", "grayscale:1"} {
+		_, err = NewParams("fill", 10, 10, "", 0, []string{f})
+		require.Error(t, err, f)
+	}
+}
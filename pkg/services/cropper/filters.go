@@ -0,0 +1,74 @@
+package cropper
+
+import (
+	"image"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/pkg/errors"
+)
+
+// Filter is an adjustment applied to the preview after resizing,
+// written as "name" or "name:value", e.g. "grayscale" or "blur:1.5".
+type Filter struct {
+	Name  string
+	Value float64
+}
+
+var filters = map[string]struct {
+	hasValue bool
+	apply    func(img image.Image, value float64) image.Image
+}{
+	"grayscale": {false, func(img image.Image, _ float64) image.Image {
+		return imaging.Grayscale(img)
+	}},
+	"invert": {false, func(img image.Image, _ float64) image.Image {
+		return imaging.Invert(img)
+	}},
+	"blur": {true, func(img image.Image, sigma float64) image.Image {
+		return imaging.Blur(img, sigma)
+	}},
+	"sharpen": {true, func(img image.Image, sigma float64) image.Image {
+		return imaging.Sharpen(img, sigma)
+	}},
+	"brightness": {true, func(img image.Image, percentage float64) image.Image {
+		return imaging.AdjustBrightness(img, percentage)
+	}},
+	"contrast": {true, func(img image.Image, percentage float64) image.Image {
+		return imaging.AdjustContrast(img, percentage)
+	}},
+	"saturation": {true, func(img image.Image, percentage float64) image.Image {
+		return imaging.AdjustSaturation(img, percentage)
+	}},
+	"gamma": {true, func(img image.Image, gamma float64) image.Image {
+		return imaging.AdjustGamma(img, gamma)
+	}},
+}
+
+// ParseFilter parses the "name[:value]" filter notation.
+func ParseFilter(raw string) (Filter, error) {
+	name, rawValue := raw, ""
+	if i := strings.Index(raw, ":"); i >= 0 {
+		name, rawValue = raw[:i], raw[i+1:]
+	}
+	f, ok := filters[name]
+	if !ok {
+		return Filter{}, errors.Errorf("unknown filter %q", name)
+	}
+	if !f.hasValue {
+		if rawValue != "" {
+			return Filter{}, errors.Errorf("filter %q takes no value", name)
+		}
+		return Filter{Name: name}, nil
+	}
+	value, err := strconv.ParseFloat(rawValue, 64)
+	if err != nil {
+		return Filter{}, errors.Wrapf(err, "invalid value of filter %q", name)
+	}
+	return Filter{Name: name, Value: value}, nil
+}
+
+func (f Filter) apply(img image.Image) image.Image {
+	return filters[f.Name].apply(img, f.Value)
+}
@@ -0,0 +1,28 @@
+package cropper
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	stageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "image_previewer",
+		Subsystem: "transform",
+		Name:      "stage_duration_seconds",
+		Help:      "Duration of decode, transform and encode stages of previews.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"stage"})
+	jobsRunning = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "image_previewer",
+		Subsystem: "transform",
+		Name:      "jobs_running",
+		Help:      "Transformations being run by pool workers.",
+	})
+	jobsQueued = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "image_previewer",
+		Subsystem: "transform",
+		Name:      "jobs_queued",
+		Help:      "Transformations waiting for a free pool worker.",
+	})
+)
@@ -0,0 +1,76 @@
+package cropper
+
+import (
+	"github.com/bestleg/ImagePreviewer/pkg/utils"
+	"github.com/pkg/errors"
+)
+
+// Params describe the preview to produce from a source image.
+type Params struct {
+	Width      int
+	Height     int
+	CropFormat uint8
+	// Format is utils.FormatJPEG or utils.FormatPNG, empty means JPEG.
+	Format string
+	// Quality is the JPEG quality in 1..100, zero means the encoder default.
+	Quality int
+	Filters []Filter
+}
+
+// NewParams validates a preview description given in its textual form.
+func NewParams(mode string, width, height int, format string, quality int, rawFilters []string) (Params, error) {
+	cropFormat, err := ParseCropFormat(mode)
+	if err != nil {
+		return Params{}, err
+	}
+	// Resize keeps the aspect ratio for a zero side, fill needs both of them.
+	if width < 0 || height < 0 || width == 0 && height == 0 ||
+		cropFormat == utils.Fill && (width == 0 || height == 0) {
+		return Params{}, errors.Wrapf(utils.ErrInvalidSize, "%dx%d", width, height)
+	}
+	switch format {
+	case "", utils.FormatJPEG, utils.FormatPNG:
+	default:
+		return Params{}, errors.Errorf("not supported output format %q", format)
+	}
+	if quality < 0 || quality > 100 {
+		return Params{}, errors.Errorf("quality %d is out of range 1..100", quality)
+	}
+	params := Params{Width: width, Height: height, CropFormat: cropFormat, Format: format, Quality: quality}
+	for _, raw := range rawFilters {
+		f, err := ParseFilter(raw)
+		if err != nil {
+			return Params{}, err
+		}
+		params.Filters = append(params.Filters, f)
+	}
+	return params, nil
+}
+
+// ParseCropFormat converts the crop mode of the request path to its constant.
+func ParseCropFormat(mode string) (uint8, error) {
+	switch mode {
+	case "fill":
+		return utils.Fill, nil
+	case "resize":
+		return utils.Resize, nil
+	default:
+		return 0, errors.Wrapf(utils.ErrNotSupportedCropFormat, "wrong type of crop image: %s", mode)
+	}
+}
+
+// ContentType returns the MIME type of the encoded preview.
+func (p Params) ContentType() string {
+	if p.Format == utils.FormatPNG {
+		return "image/png"
+	}
+	return "image/jpeg"
+}
+
+// Extension returns the file extension of the encoded preview.
+func (p Params) Extension() string {
+	if p.Format == utils.FormatPNG {
+		return ".png"
+	}
+	return ".jpeg"
+}
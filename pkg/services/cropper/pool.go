@@ -0,0 +1,95 @@
+package cropper
+
+import (
+	"context"
+	"runtime"
+	"time"
+
+	"github.com/bestleg/ImagePreviewer/pkg/utils"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+)
+
+// Pool runs transformations of the wrapped Transformer on a bounded number
+// of workers, rejecting jobs when its queue is full or the wait is too long.
+type Pool struct {
+	next         Transformer
+	workers      chan struct{}
+	jobs         chan struct{}
+	queueTimeout time.Duration
+}
+
+// NewPool limits next to workers simultaneous jobs, GOMAXPROCS if workers is zero,
+// with up to queueSize more jobs waiting at most queueTimeout for a worker.
+func NewPool(next Transformer, workers, queueSize int, queueTimeout time.Duration) *Pool {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+	return &Pool{
+		next:         next,
+		workers:      make(chan struct{}, workers),
+		jobs:         make(chan struct{}, workers+queueSize),
+		queueTimeout: queueTimeout,
+	}
+}
+
+func (p *Pool) Crop(ctx context.Context, img []byte, params Params) ([]byte, error) {
+	select {
+	case p.jobs <- struct{}{}:
+	default:
+		return nil, errors.Wrapf(utils.ErrOverloaded, "%d jobs are queued", cap(p.jobs))
+	}
+	defer func() { <-p.jobs }()
+
+	jobsQueued.Inc()
+	_, span := otel.Tracer(tracerName).Start(ctx, "transform.queue")
+	err := p.waitWorker(ctx)
+	span.End()
+	jobsQueued.Dec()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { <-p.workers }()
+	jobsRunning.Inc()
+	defer jobsRunning.Dec()
+
+	return p.next.Crop(ctx, img, params)
+}
+
+func (p *Pool) waitWorker(ctx context.Context) error {
+	var timeout <-chan time.Time
+	if p.queueTimeout > 0 {
+		timer := time.NewTimer(p.queueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case p.workers <- struct{}{}:
+		return nil
+	case <-timeout:
+		return errors.Wrapf(utils.ErrOverloaded, "no free worker in %s", p.queueTimeout)
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "waiting for a worker")
+	}
+}
+
+// Running returns the number of jobs being transformed.
+func (p *Pool) Running() int {
+	return len(p.workers)
+}
+
+// Queued returns the number of jobs waiting for a worker.
+func (p *Pool) Queued() int {
+	if queued := len(p.jobs) - len(p.workers); queued > 0 {
+		return queued
+	}
+	return 0
+}
+
+// Saturated reports whether new jobs are rejected because the queue is full.
+func (p *Pool) Saturated() bool {
+	return len(p.jobs) == cap(p.jobs)
+}
@@ -0,0 +1,81 @@
+package cropper
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bestleg/ImagePreviewer/pkg/utils"
+	"github.com/stretchr/testify/require"
+)
+
+type blockingTransformer struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (t blockingTransformer) Crop(context.Context, []byte, Params) ([]byte, error) {
+	t.started <- struct{}{}
+	<-t.release
+	return []byte("preview"), nil
+}
+
+func newBlockingTransformer() blockingTransformer {
+	return blockingTransformer{started: make(chan struct{}, 1), release: make(chan struct{})}
+}
+
+func TestPoolQueueTimeout(t *testing.T) {
+	next := newBlockingTransformer()
+	pool := NewPool(next, 1, 1, 10*time.Millisecond)
+	go func() {
+		_, _ = pool.Crop(context.Background(), nil, Params{})
+	}()
+	<-next.started
+	defer close(next.release)
+	require.Equal(t, 1, pool.Running())
+
+	_, err := pool.Crop(context.Background(), nil, Params{})
+	require.ErrorIs(t, err, utils.ErrOverloaded)
+	require.Zero(t, pool.Queued())
+}
+
+func TestPoolQueueFull(t *testing.T) {
+	next := newBlockingTransformer()
+	pool := NewPool(next, 1, 1, time.Minute)
+	results := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := pool.Crop(context.Background(), nil, Params{})
+			results <- err
+		}()
+	}
+	<-next.started
+	require.Eventually(t, func() bool { return pool.Queued() == 1 }, time.Second, time.Millisecond)
+	require.True(t, pool.Saturated())
+
+	_, err := pool.Crop(context.Background(), nil, Params{})
+	require.ErrorIs(t, err, utils.ErrOverloaded)
+
+	close(next.release)
+	require.NoError(t, <-results)
+	require.NoError(t, <-results)
+	require.False(t, pool.Saturated())
+	require.Zero(t, pool.Running())
+	require.Zero(t, pool.Queued())
+}
+
+func TestPoolCanceledWait(t *testing.T) {
+	next := newBlockingTransformer()
+	pool := NewPool(next, 1, 1, 0)
+	go func() {
+		_, _ = pool.Crop(context.Background(), nil, Params{})
+	}()
+	<-next.started
+	defer close(next.release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := pool.Crop(ctx, nil, Params{})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Zero(t, pool.Queued())
+}
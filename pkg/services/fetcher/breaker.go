@@ -0,0 +1,174 @@
+package fetcher
+
+import (
+	"sync"
+	"time"
+)
+
+type breakerState int
+
+const (
+	stateClosed breakerState = iota
+	stateOpen
+	stateHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case stateOpen:
+		return "open"
+	case stateHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker stops requests to an origin host after consecutive failures.
+// Once the cooldown passes a single probe request is let through, its outcome
+// either closes the breaker or opens it for another cooldown.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	hosts     map[string]*hostBreaker
+	now       func() time.Time
+	lastSweep time.Time
+	// label names a host in breakerStates, otherHost for hosts it mustn't name.
+	label func(host string) string
+}
+
+type hostBreaker struct {
+	label    string
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+	lastSeen time.Time
+}
+
+type outcome int
+
+const (
+	outcomeSuccess outcome = iota
+	outcomeFailure
+	// outcomeNeutral says nothing about origin health, e.g. a cancelled request.
+	outcomeNeutral
+)
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		hosts:     make(map[string]*hostBreaker),
+		now:       time.Now,
+		label:     func(string) string { return otherHost },
+	}
+}
+
+// allow reports whether a request to the host may be made, every allowed
+// request must be followed by record.
+func (b *circuitBreaker) allow(host string) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sweep()
+
+	h, ok := b.hosts[host]
+	if !ok {
+		return true
+	}
+	h.lastSeen = b.now()
+	switch h.state {
+	case stateOpen:
+		if b.now().Sub(h.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(host, h, stateHalfOpen)
+		h.probing = true
+		return true
+	case stateHalfOpen:
+		if h.probing {
+			return false
+		}
+		h.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+func (b *circuitBreaker) record(host string, result outcome) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	h, ok := b.hosts[host]
+	if !ok {
+		if result != outcomeFailure {
+			return
+		}
+		h = &hostBreaker{label: b.label(host)}
+		b.hosts[host] = h
+	}
+	h.probing = false
+	h.lastSeen = b.now()
+
+	switch result {
+	case outcomeSuccess:
+		delete(b.hosts, host)
+		h.unpublish()
+	case outcomeFailure:
+		h.failures++
+		if h.state == stateHalfOpen || h.failures >= b.threshold {
+			h.openedAt = b.now()
+			b.setState(host, h, stateOpen)
+		}
+	case outcomeNeutral:
+	}
+}
+
+// sweep forgets hosts nobody has requested for idleHostTTL, clients choose
+// hosts so failing ones would otherwise pile up. An open breaker is kept for
+// idleHostTTL after its cooldown too, so that forgetting it doesn't skip the probe.
+func (b *circuitBreaker) sweep() {
+	now := b.now()
+	if now.Sub(b.lastSweep) < idleHostTTL {
+		return
+	}
+	b.lastSweep = now
+	for host, h := range b.hosts {
+		if h.probing || now.Sub(h.lastSeen) < idleHostTTL {
+			continue
+		}
+		if h.state == stateOpen && now.Sub(h.openedAt) < b.cooldown+idleHostTTL {
+			continue
+		}
+		delete(b.hosts, host)
+		h.unpublish()
+	}
+}
+
+func (b *circuitBreaker) setState(host string, h *hostBreaker, state breakerState) {
+	h.unpublish()
+	h.state = state
+	if state != stateClosed {
+		breakerStates.WithLabelValues(h.label, state.String()).Inc()
+	}
+}
+
+// unpublish removes the breaker from breakerStates. A series of a named host
+// counts just its breaker, so it is deleted instead of staying at zero.
+func (h *hostBreaker) unpublish() {
+	switch {
+	case h.state == stateClosed:
+	case h.label == otherHost:
+		breakerStates.WithLabelValues(h.label, h.state.String()).Dec()
+	default:
+		breakerStates.DeleteLabelValues(h.label, h.state.String())
+	}
+}
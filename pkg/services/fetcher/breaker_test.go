@@ -0,0 +1,98 @@
+package fetcher
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bestleg/ImagePreviewer/pkg/utils"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := newCircuitBreaker(2, time.Minute)
+	b.now = func() time.Time { return now }
+	b.label = func(host string) string { return host }
+	const host = "origin.test"
+
+	require.True(t, b.allow(host))
+	b.record(host, outcomeFailure)
+	require.True(t, b.allow(host))
+	b.record(host, outcomeFailure)
+	require.False(t, b.allow(host), "opens after threshold")
+	require.Equal(t, 1.0, testutil.ToFloat64(breakerStates.WithLabelValues(host, "open")))
+
+	now = now.Add(time.Minute)
+	require.True(t, b.allow(host), "half-open probe")
+	require.False(t, breakerStates.DeleteLabelValues(host, "open"), "open series is gone")
+	require.False(t, b.allow(host), "single probe at a time")
+	b.record(host, outcomeNeutral)
+	require.True(t, b.allow(host), "neutral outcome releases the probe")
+	b.record(host, outcomeFailure)
+	require.False(t, b.allow(host), "failed probe opens again")
+
+	now = now.Add(time.Minute)
+	require.True(t, b.allow(host))
+	b.record(host, outcomeSuccess)
+	require.True(t, b.allow(host))
+	require.True(t, b.allow(host), "closed after successful probe")
+	require.False(t, breakerStates.DeleteLabelValues(host, "half-open"), "closed breaker has no state")
+}
+
+func TestFetchCircuitBreaker(t *testing.T) {
+	var calls int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer origin.Close()
+
+	f := newTestFetcher(WithCircuitBreaker(2, time.Hour))
+	for i := 0; i < 2; i++ {
+		_, err := f.Fetch(context.Background(), origin.URL, http.Header{})
+		require.ErrorIs(t, err, utils.ErrOriginBadStatus)
+	}
+	_, err := f.Fetch(context.Background(), origin.URL, http.Header{})
+	require.ErrorIs(t, err, utils.ErrCircuitOpen)
+	require.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestCircuitBreakerForgetsIdleHosts(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := newCircuitBreaker(2, 2*idleHostTTL)
+	b.now = func() time.Time { return now }
+	b.label = func(host string) string { return host }
+
+	b.record("open.test", outcomeFailure)
+	b.record("open.test", outcomeFailure)
+	b.record("flaky.test", outcomeFailure)
+	require.Len(t, b.hosts, 2)
+
+	now = now.Add(idleHostTTL)
+	require.False(t, b.allow("open.test"), "open until cooldown passes")
+	require.Len(t, b.hosts, 1, "idle closed host is forgotten")
+
+	now = now.Add(2 * idleHostTTL)
+	require.True(t, b.allow("other.test"))
+	require.Empty(t, b.hosts, "idle open host is forgotten after cooldown")
+	require.False(t, breakerStates.DeleteLabelValues("open.test", "open"))
+}
+
+func TestCircuitBreakerStatesOfUnlistedHosts(t *testing.T) {
+	b := newCircuitBreaker(1, time.Hour)
+	open := breakerStates.WithLabelValues(otherHost, "open")
+	before := testutil.ToFloat64(open)
+
+	b.record("a.test", outcomeFailure)
+	b.record("b.test", outcomeFailure)
+	require.Equal(t, before+2, testutil.ToFloat64(open), "unlisted hosts are counted together")
+	require.False(t, breakerStates.DeleteLabelValues("a.test", "open"))
+
+	b.record("a.test", outcomeSuccess)
+	require.Equal(t, before+1, testutil.ToFloat64(open))
+}
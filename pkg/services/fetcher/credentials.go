@@ -0,0 +1,107 @@
+package fetcher
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/bestleg/ImagePreviewer/pkg/services/policy"
+	"github.com/bestleg/ImagePreviewer/pkg/utils"
+	"github.com/pkg/errors"
+)
+
+// Credentials authenticate requests to origins matching Origins patterns,
+// see policy.NewOriginPolicy for the pattern format. Only one of the
+// authentication methods is expected to be set, Headers may accompany any.
+// Secrets of Basic, BearerToken and Headers are never sent over plain http,
+// such requests are upgraded to https with UpgradeHTTPS and refused otherwise.
+type Credentials struct {
+	Origins      []string
+	Basic        *BasicAuth
+	BearerToken  string
+	Headers      map[string]string
+	SigV4        *SigV4
+	UpgradeHTTPS bool
+}
+
+// BasicAuth is HTTP basic authentication.
+type BasicAuth struct {
+	Username string
+	Password string
+}
+
+type credentialRule struct {
+	origins *policy.OriginPolicy
+	creds   Credentials
+}
+
+// CredentialStore applies the first matching credentials to origin requests.
+type CredentialStore struct {
+	rules []credentialRule
+	// headers lists every header credentials may set, to strip them on redirects.
+	headers []string
+	now     func() time.Time
+}
+
+// NewCredentialStore validates origin patterns of the credentials.
+func NewCredentialStore(creds []Credentials) (*CredentialStore, error) {
+	store := &CredentialStore{
+		headers: []string{"Authorization", amzDateHeader, amzContentHeader, amzTokenHeader},
+		now:     time.Now,
+	}
+	for i, c := range creds {
+		// An empty pattern list allows every origin, credentials must never go everywhere.
+		if len(c.Origins) == 0 {
+			return nil, errors.Errorf("credentials #%d have no origins to match", i+1)
+		}
+		origins, err := policy.NewOriginPolicy(c.Origins, nil)
+		if err != nil {
+			return nil, err
+		}
+		store.rules = append(store.rules, credentialRule{origins: origins, creds: c})
+		for name := range c.Headers {
+			store.headers = append(store.headers, name)
+		}
+	}
+	return store, nil
+}
+
+// apply removes credentials left from a previous hop and authenticates
+// the request if its origin has credentials configured.
+func (s *CredentialStore) apply(request *http.Request) error {
+	if s == nil {
+		return nil
+	}
+	for _, name := range s.headers {
+		request.Header.Del(name)
+	}
+	for _, r := range s.rules {
+		if !r.origins.Allowed(request.URL) {
+			continue
+		}
+		if request.URL.Scheme == "http" && r.creds.secret() {
+			if !r.creds.UpgradeHTTPS {
+				return errors.Wrapf(utils.ErrOriginNotAllowed, "credentials of %s are not sent over plain http",
+					request.URL.Host)
+			}
+			request.URL.Scheme = "https"
+		}
+		for name, value := range r.creds.Headers {
+			request.Header.Set(name, value)
+		}
+		switch {
+		case r.creds.Basic != nil:
+			request.SetBasicAuth(r.creds.Basic.Username, r.creds.Basic.Password)
+		case r.creds.BearerToken != "":
+			request.Header.Set("Authorization", "Bearer "+r.creds.BearerToken)
+		case r.creds.SigV4 != nil:
+			r.creds.SigV4.sign(request, s.now())
+		}
+		return nil
+	}
+	return nil
+}
+
+// secret reports whether the credentials are sent as is, unlike a SigV4 signature.
+func (c Credentials) secret() bool {
+	return c.Basic != nil || c.BearerToken != "" || len(c.Headers) > 0
+}
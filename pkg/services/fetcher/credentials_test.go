@@ -0,0 +1,116 @@
+package fetcher
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bestleg/ImagePreviewer/pkg/utils"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// TestSigV4 uses vectors of the AWS Signature Version 4 test suite.
+func TestSigV4(t *testing.T) {
+	signer := &SigV4{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		Region:          "us-east-1",
+		Service:         "service",
+	}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+
+	tests := []struct {
+		url       string
+		signature string
+	}{
+		{"https://example.amazonaws.com/", "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+		{"https://example.amazonaws.com/?Param2=value2&Param1=value1", "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500"},
+	}
+	for _, tt := range tests {
+		request, err := http.NewRequestWithContext(context.Background(), http.MethodGet, tt.url, nil)
+		require.NoError(t, err)
+		signer.sign(request, now)
+		require.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+			"SignedHeaders=host;x-amz-date, Signature="+tt.signature, request.Header.Get("Authorization"), tt.url)
+		require.Equal(t, "20150830T123600Z", request.Header.Get(amzDateHeader))
+	}
+}
+
+func TestFetchCredentials(t *testing.T) {
+	var other, private http.Header
+	otherOrigin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		other = r.Header.Clone()
+		w.Header().Set("Content-Type", "image/jpeg")
+	}))
+	defer otherOrigin.Close()
+	privateOrigin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		private = r.Header.Clone()
+		if r.URL.Path == "/moved" {
+			// localhost is a different origin for the credentials rules.
+			http.Redirect(w, r, "http://localhost"+otherOrigin.URL[len("http://127.0.0.1"):], http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+	}))
+	defer privateOrigin.Close()
+
+	store, err := NewCredentialStore([]Credentials{
+		{Origins: []string{strings.TrimPrefix(privateOrigin.URL, "https://")}, Basic: &BasicAuth{"user", "pass"}, Headers: map[string]string{"X-Api-Key": "k"}},
+		{Origins: []string{"bearer.example.com"}, BearerToken: "token"},
+	})
+	require.NoError(t, err)
+	loopback, err := ParseNetworks("127.0.0.0/8,::1")
+	require.NoError(t, err)
+	f := NewFetcher(zap.NewNop().Sugar(), time.Second, time.Second,
+		WithAllowedNetworks(loopback), WithCredentials(store))
+	f.transport.(*http.Transport).TLSClientConfig = privateOrigin.Client().Transport.(*http.Transport).TLSClientConfig
+
+	_, err = f.Fetch(context.Background(), privateOrigin.URL+"/img.jpg", http.Header{})
+	require.NoError(t, err)
+	username, password, ok := (&http.Request{Header: private}).BasicAuth()
+	require.True(t, ok)
+	require.Equal(t, "user", username)
+	require.Equal(t, "pass", password)
+	require.Equal(t, "k", private.Get("X-Api-Key"))
+
+	_, err = f.Fetch(context.Background(), privateOrigin.URL+"/moved", http.Header{})
+	require.NoError(t, err)
+	require.Empty(t, other.Get("Authorization"))
+	require.Empty(t, other.Get("X-Api-Key"))
+}
+
+func TestCredentialsOverPlainHTTP(t *testing.T) {
+	store, err := NewCredentialStore([]Credentials{
+		{Origins: []string{"private.example.com"}, BearerToken: "token"},
+		{Origins: []string{"upgraded.example.com"}, BearerToken: "token", UpgradeHTTPS: true},
+		{Origins: []string{"bucket.example.com"}, SigV4: &SigV4{AccessKeyID: "id", SecretAccessKey: "secret"}},
+	})
+	require.NoError(t, err)
+
+	request := httptest.NewRequest(http.MethodGet, "http://private.example.com/img.jpg", nil)
+	require.ErrorIs(t, store.apply(request), utils.ErrOriginNotAllowed)
+	require.Empty(t, request.Header.Get("Authorization"))
+
+	request = httptest.NewRequest(http.MethodGet, "http://upgraded.example.com/img.jpg", nil)
+	require.NoError(t, store.apply(request))
+	require.Equal(t, "https", request.URL.Scheme)
+	require.Equal(t, "Bearer token", request.Header.Get("Authorization"))
+
+	request = httptest.NewRequest(http.MethodGet, "http://bucket.example.com/img.jpg", nil)
+	require.NoError(t, store.apply(request))
+	require.Equal(t, "http", request.URL.Scheme, "a signature is not a secret")
+	require.NotEmpty(t, request.Header.Get("Authorization"))
+}
+
+func TestCredentialsRequireOrigins(t *testing.T) {
+	for _, origins := range [][]string{nil, {}} {
+		_, err := NewCredentialStore([]Credentials{{Origins: origins, BearerToken: "secret"}})
+		require.Error(t, err)
+	}
+	_, err := NewCredentialStore([]Credentials{{Origins: []string{"example.com"}, BearerToken: "secret"}})
+	require.NoError(t, err)
+}
@@ -2,95 +2,392 @@ package fetcher
 
 import (
 	"context"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"time"
 
+	"github.com/bestleg/ImagePreviewer/pkg/logging"
+	"github.com/bestleg/ImagePreviewer/pkg/services/policy"
 	"github.com/bestleg/ImagePreviewer/pkg/utils"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
+const (
+	defaultMaxRedirects = 5
+	maxIdleConns        = 100
+	idleConnTimeout     = 90 * time.Second
+)
+
+// tracerName identifies spans of the fetcher. The tracer is looked up on use, tracers
+// created before the provider is set would keep delegating to the first one set.
+const tracerName = "github.com/bestleg/ImagePreviewer/pkg/services/fetcher"
+
 type Fetcher interface {
-	Fetch(ctx context.Context, url string, header http.Header) ([]byte, error)
+	Fetch(ctx context.Context, url string, header http.Header) (*Image, error)
+}
+
+// Image is a downloaded origin image.
+type Image struct {
+	Data []byte
+	// URL is the address the image was finally served from after redirects.
+	URL string
+	// Redirects is the number of redirects followed to URL.
+	Redirects int
 }
 
 type HTTPFetcher struct {
 	logger         *zap.SugaredLogger
 	transport      http.RoundTripper
 	requestTimeout time.Duration
+	maxSourceSize  int64
+	allowedNets    []*net.IPNet
+	maxRedirects   int
+	originPolicy   *policy.OriginPolicy
+	headerPolicy   *HeaderPolicy
+	credentials    *CredentialStore
+	maxAttempts    int
+	retryDelay     time.Duration
+	breaker        *circuitBreaker
+	hostLimiter    *hostLimiter
+	idleConns      int
+}
+
+// Option configures optional HTTPFetcher behavior.
+type Option func(*HTTPFetcher)
+
+// WithMaxSourceSize limits the size of origin responses in bytes, zero disables the limit.
+func WithMaxSourceSize(size int64) Option {
+	return func(f *HTTPFetcher) {
+		f.maxSourceSize = size
+	}
+}
+
+// WithAllowedNetworks lets the fetcher connect to the given networks even
+// if they fall into ranges blocked by the SSRF protection.
+func WithAllowedNetworks(nets []*net.IPNet) Option {
+	return func(f *HTTPFetcher) {
+		f.allowedNets = nets
+	}
+}
+
+// WithMaxRedirects limits the number of redirects followed, zero disables following.
+func WithMaxRedirects(n int) Option {
+	return func(f *HTTPFetcher) {
+		f.maxRedirects = n
+	}
+}
+
+// WithOriginPolicy checks every redirect hop against the origin policy.
+func WithOriginPolicy(op *policy.OriginPolicy) Option {
+	return func(f *HTTPFetcher) {
+		f.originPolicy = op
+	}
+}
+
+// WithHeaderPolicy sets which client headers are forwarded to origins.
+func WithHeaderPolicy(hp *HeaderPolicy) Option {
+	return func(f *HTTPFetcher) {
+		f.headerPolicy = hp
+	}
 }
 
-func NewFetcher(l *zap.SugaredLogger, connectTimeout time.Duration, requestTimeout time.Duration) *HTTPFetcher {
-	return &HTTPFetcher{
+// WithCredentials authenticates requests to origins with configured credentials.
+func WithCredentials(store *CredentialStore) Option {
+	return func(f *HTTPFetcher) {
+		f.credentials = store
+	}
+}
+
+// WithRetries retries transient failures up to maxAttempts in total, waiting
+// a jittered exponentially growing delay starting from baseDelay in between.
+func WithRetries(maxAttempts int, baseDelay time.Duration) Option {
+	return func(f *HTTPFetcher) {
+		f.maxAttempts = maxAttempts
+		f.retryDelay = baseDelay
+	}
+}
+
+// WithCircuitBreaker fails fast for an origin host after threshold consecutive
+// failures until cooldown passes, zero threshold disables the breaker.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) Option {
+	return func(f *HTTPFetcher) {
+		f.breaker = nil
+		if threshold > 0 {
+			f.breaker = newCircuitBreaker(threshold, cooldown)
+		}
+	}
+}
+
+// WithHostLimits limits concurrency and request rate per origin host.
+func WithHostLimits(limits HostLimits) Option {
+	return func(f *HTTPFetcher) {
+		f.hostLimiter = newHostLimiter(limits)
+	}
+}
+
+// WithIdleConnsPerHost sets how many keep-alive connections are pooled per origin host.
+func WithIdleConnsPerHost(n int) Option {
+	return func(f *HTTPFetcher) {
+		f.idleConns = n
+	}
+}
+
+func NewFetcher(
+	l *zap.SugaredLogger,
+	connectTimeout time.Duration,
+	requestTimeout time.Duration,
+	opts ...Option,
+) *HTTPFetcher {
+	f := &HTTPFetcher{
 		logger:         l,
 		requestTimeout: requestTimeout,
-		transport: &http.Transport{
-			DialContext: (&net.Dialer{
-				Timeout: connectTimeout,
-			}).DialContext,
-		},
+		maxRedirects:   defaultMaxRedirects,
+		headerPolicy:   defaultHeaderPolicy(),
+		maxAttempts:    1,
+		idleConns:      http.DefaultMaxIdleConnsPerHost,
 	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	if f.breaker != nil {
+		f.breaker.label = f.breakerHost
+	}
+	f.transport = &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: connectTimeout,
+			// Addresses are checked after DNS resolution, right before connecting.
+			Control: addressFilter{allowed: f.allowedNets}.control,
+		}).DialContext,
+		// A custom DialContext disables HTTP/2 unless it is forced explicitly.
+		ForceAttemptHTTP2:   true,
+		TLSHandshakeTimeout: connectTimeout,
+		MaxIdleConns:        maxIdleConns,
+		MaxIdleConnsPerHost: f.idleConns,
+		IdleConnTimeout:     idleConnTimeout,
+	}
+	return f
 }
 
-func (f HTTPFetcher) Fetch(ctx context.Context, url string, header http.Header) ([]byte, error) {
-	proxyRequest, err := prepareRequest(ctx, url, header)
+func (f HTTPFetcher) Fetch(ctx context.Context, url string, header http.Header) (*Image, error) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "fetch", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	image, err := f.fetch(ctx, url, header)
 	if err != nil {
-		return nil, errors.Wrap(err, utils.ErrPrepareRequest)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 	}
-	responseBody, err := f.doRequest(proxyRequest)
-	if err != nil {
-		return nil, errors.Wrap(err, utils.ErrMakingRequest)
+	return image, err
+}
+
+func (f HTTPFetcher) fetch(ctx context.Context, url string, header http.Header) (*Image, error) {
+	// The request timeout bounds all attempts together with the delays between them.
+	if f.requestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.requestTimeout)
+		defer cancel()
+	}
+
+	for attempt := 1; ; attempt++ {
+		proxyRequest, err := f.prepareRequest(ctx, url, header)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to prepare request")
+		}
+		host := proxyRequest.URL.Host
+		trace.SpanFromContext(ctx).SetAttributes(attribute.String("http.host", host), attribute.Int("fetch.attempt", attempt))
+		if !f.breaker.allow(host) {
+			return nil, errors.Wrapf(utils.ErrCircuitOpen, "origin %s", host)
+		}
+		release, err := f.hostLimiter.acquire(ctx, host)
+		if err != nil {
+			f.breaker.record(host, outcomeNeutral)
+			return nil, err
+		}
+		start := time.Now()
+		image, err := f.doRequest(proxyRequest)
+		release()
+		fetchDuration.WithLabelValues(f.metricHost(proxyRequest.URL), fetchResult(err)).Observe(time.Since(start).Seconds())
+		f.breaker.record(host, classifyOutcome(err))
+		if err == nil {
+			return image, nil
+		}
+		if attempt >= f.maxAttempts || !isRetryable(err) || !f.waitRetry(ctx, attempt, err) {
+			return nil, errors.Wrap(err, "error making request")
+		}
+		logging.FromContext(ctx, f.logger).Warnf("retrying request to %s after attempt %d: %v", proxyRequest.URL.Host, attempt, err)
 	}
-	return responseBody, nil
 }
 
-func prepareRequest(ctx context.Context, rawURL string, header http.Header) (*http.Request, error) {
+func (f *HTTPFetcher) prepareRequest(ctx context.Context, rawURL string, header http.Header) (*http.Request, error) {
 	request, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
 	if err != nil {
-		return nil, errors.Wrap(err, utils.ErrFailedToCreateProxyRequest)
+		return nil, utils.WithKind(utils.ErrFailedToCreateProxyRequest, err)
 	}
 	parsedURL, err := url.Parse(rawURL)
 	if err != nil {
-		return nil, errors.Wrap(err, utils.ErrFailedToParseImageURL)
+		return nil, utils.WithKind(utils.ErrFailedToParseImageURL, err)
 	}
-	if parsedURL.Scheme != "http" {
-		return nil, errors.New(utils.ErrNotSupportedScheme)
+	if !utils.Contains([]string{"http", "https"}, parsedURL.Scheme) {
+		return nil, utils.ErrNotSupportedScheme
 	}
 	request.URL = parsedURL
-	request.Header = header
+	request.Header = f.headerPolicy.Apply(parsedURL, header)
+	if id := logging.RequestID(ctx); id != "" {
+		request.Header.Set(logging.RequestIDHeader, id)
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(request.Header))
+	if err := f.credentials.apply(request); err != nil {
+		return nil, err
+	}
 	return request, nil
 }
 
-func (f *HTTPFetcher) doRequest(request *http.Request) ([]byte, error) {
+func (f *HTTPFetcher) doRequest(request *http.Request) (*Image, error) {
 	client := http.Client{
-		Timeout:   f.requestTimeout,
-		Transport: f.transport,
+		Timeout:       f.requestTimeout,
+		Transport:     f.transport,
+		CheckRedirect: f.checkRedirect,
 	}
 
 	resp, err := client.Do(request)
 	if err != nil {
-		return nil, errors.Wrap(err, utils.ErrFailedToPerformRequest)
+		if isTimeout(err) {
+			return nil, utils.WithKind(utils.ErrOriginTimeout, err)
+		}
+		return nil, utils.WithKind(utils.ErrFailedToPerformRequest, err)
 	}
 	defer func() {
 		if errClose := resp.Body.Close(); errClose != nil {
-			f.logger.Errorf("failed to close body %v", errClose)
+			logging.FromContext(request.Context(), f.logger).Errorf("failed to close body %v", errClose)
 		}
 	}()
 
+	if err := checkStatus(resp); err != nil {
+		logging.FromContext(request.Context(), f.logger).Warnf("origin %s responded with status %d", request.URL.Host, resp.StatusCode)
+		return nil, err
+	}
+
 	if !utils.Contains([]string{utils.SupportedContentTypes}, resp.Header.Get("Content-type")) {
-		return nil, errors.New(utils.ErrNotSupportedContentType)
+		return nil, utils.ErrNotSupportedContentType
+	}
+
+	if resp.ProtoMajor != 1 && resp.ProtoMajor != 2 {
+		return nil, errors.Wrap(utils.ErrNotSupportedProto, resp.Proto)
+	}
+
+	buff, err := f.readBody(resp)
+	if err != nil {
+		return nil, err
+	}
+	fetchBytes.WithLabelValues(f.metricHost(request.URL)).Add(float64(len(buff)))
+	return &Image{Data: buff, URL: resp.Request.URL.String(), Redirects: redirects(resp)}, nil
+}
+
+// redirects counts the hops which led to resp, every redirected request
+// keeps the response that caused it.
+func redirects(resp *http.Response) int {
+	n := 0
+	for r := resp.Request; r.Response != nil; r = r.Response.Request {
+		n++
 	}
+	return n
+}
 
-	if resp.Proto != utils.SupportedHeader {
-		return nil, errors.New(utils.ErrNotSupportedHeader)
+// checkRedirect validates every redirect hop like the original request,
+// the SSRF protection is applied by the dialer on each new connection.
+func (f *HTTPFetcher) checkRedirect(request *http.Request, via []*http.Request) error {
+	if len(via) > f.maxRedirects {
+		return errors.Wrapf(utils.ErrTooManyRedirects, "stopped after %d redirects", f.maxRedirects)
+	}
+	if !utils.Contains([]string{"http", "https"}, request.URL.Scheme) {
+		return errors.Wrapf(utils.ErrNotSupportedScheme, "redirect to %s", request.URL.Redacted())
+	}
+	if !f.originPolicy.Allowed(request.URL) {
+		return errors.Wrapf(utils.ErrOriginNotAllowed, "redirect to %s%s", request.URL.Host, request.URL.Path)
 	}
+	// Credentials of the previous hop must not leak to another origin.
+	if err := f.credentials.apply(request); err != nil {
+		return err
+	}
+	logging.FromContext(request.Context(), f.logger).Debugf("following redirect from %s to %s", via[len(via)-1].URL.Redacted(), request.URL.Redacted())
+	return nil
+}
 
-	buff, err := ioutil.ReadAll(resp.Body)
+// readBody reads the response body, enforcing the maximum source size both
+// on the declared Content-Length and on the bytes actually received.
+func (f *HTTPFetcher) readBody(resp *http.Response) ([]byte, error) {
+	body := io.Reader(resp.Body)
+	if f.maxSourceSize > 0 {
+		if resp.ContentLength > f.maxSourceSize {
+			rejectedDownloads.Inc()
+			return nil, errors.Wrapf(utils.ErrSourceTooLarge, "content length %d exceeds %d bytes",
+				resp.ContentLength, f.maxSourceSize)
+		}
+		body = io.LimitReader(resp.Body, f.maxSourceSize+1)
+	}
+
+	buff, err := ioutil.ReadAll(body)
 	if err != nil {
-		return nil, errors.Wrap(err, utils.ErrFailedToReadRequestBody)
+		if isTimeout(err) {
+			return nil, utils.WithKind(utils.ErrOriginTimeout, err)
+		}
+		return nil, utils.WithKind(utils.ErrFailedToReadRequestBody, err)
+	}
+	if f.maxSourceSize > 0 && int64(len(buff)) > f.maxSourceSize {
+		rejectedDownloads.Inc()
+		return nil, errors.Wrapf(utils.ErrSourceTooLarge, "body exceeds %d bytes", f.maxSourceSize)
 	}
 	return buff, nil
 }
+
+// checkStatus rejects any non-2xx origin response, keeping the origin status
+// in the error chain so that it can be reported to the client.
+func checkStatus(resp *http.Response) error {
+	if resp.StatusCode >= http.StatusOK && resp.StatusCode < http.StatusMultipleChoices {
+		return nil
+	}
+	upstream := &utils.UpstreamStatusError{
+		StatusCode: resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+	}
+	switch resp.StatusCode {
+	case http.StatusNotFound, http.StatusGone:
+		return utils.WithKind(utils.ErrOriginNotFound, upstream)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return utils.WithKind(utils.ErrOriginForbidden, upstream)
+	case http.StatusGatewayTimeout:
+		return utils.WithKind(utils.ErrOriginTimeout, upstream)
+	default:
+		return utils.WithKind(utils.ErrOriginBadStatus, upstream)
+	}
+}
+
+// fetchResult labels the outcome of an origin request for metrics.
+func fetchResult(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, utils.ErrOriginTimeout):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	default:
+		return "error"
+	}
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
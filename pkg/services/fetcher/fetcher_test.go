@@ -0,0 +1,292 @@
+package fetcher
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bestleg/ImagePreviewer/pkg/logging"
+	"github.com/bestleg/ImagePreviewer/pkg/services/policy"
+	"github.com/bestleg/ImagePreviewer/pkg/utils"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// newTestFetcher returns a fetcher allowed to reach in-process origins on loopback.
+func newTestFetcher(opts ...Option) *HTTPFetcher {
+	loopback, _ := ParseNetworks("127.0.0.0/8,::1")
+	opts = append([]Option{WithAllowedNetworks(loopback)}, opts...)
+	return NewFetcher(zap.NewNop().Sugar(), time.Second, time.Second, opts...)
+}
+
+func TestFetchStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		kind   error
+	}{
+		{"not found", http.StatusNotFound, utils.ErrOriginNotFound},
+		{"gone", http.StatusGone, utils.ErrOriginNotFound},
+		{"forbidden", http.StatusForbidden, utils.ErrOriginForbidden},
+		{"server error", http.StatusInternalServerError, utils.ErrOriginBadStatus},
+		{"gateway timeout", http.StatusGatewayTimeout, utils.ErrOriginTimeout},
+		{"not modified", http.StatusNotModified, utils.ErrOriginBadStatus},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "image/jpeg")
+				w.WriteHeader(tt.status)
+			}))
+			defer origin.Close()
+
+			_, err := newTestFetcher().Fetch(context.Background(), origin.URL+"/img.jpg", http.Header{})
+			require.ErrorIs(t, err, tt.kind)
+
+			var upstream *utils.UpstreamStatusError
+			require.True(t, errors.As(err, &upstream))
+			require.Equal(t, tt.status, upstream.StatusCode)
+		})
+	}
+}
+
+func TestFetchOK(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		_, _ = w.Write([]byte("image"))
+	}))
+	defer origin.Close()
+
+	image, err := newTestFetcher().Fetch(context.Background(), origin.URL+"/img.jpg", http.Header{})
+	require.NoError(t, err)
+	require.Equal(t, []byte("image"), image.Data)
+	require.Equal(t, origin.URL+"/img.jpg", image.URL)
+	require.Zero(t, image.Redirects)
+
+	image, err = newTestFetcher().Fetch(context.Background(), origin.URL+"/my img.jpg", http.Header{})
+	require.NoError(t, err)
+	require.Equal(t, origin.URL+"/my%20img.jpg", image.URL, "re-escaped")
+	require.Zero(t, image.Redirects, "re-escaping is not a redirect")
+}
+
+func TestFetchHTTP2(t *testing.T) {
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			w.WriteHeader(http.StatusHTTPVersionNotSupported)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		_, _ = w.Write([]byte("h2 image"))
+	}))
+	origin.EnableHTTP2 = true
+	origin.StartTLS()
+	defer origin.Close()
+
+	f := newTestFetcher()
+	transport := f.transport.(*http.Transport)
+	transport.TLSClientConfig = origin.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+
+	image, err := f.Fetch(context.Background(), origin.URL+"/img.jpg", http.Header{})
+	require.NoError(t, err)
+	require.Equal(t, []byte("h2 image"), image.Data)
+}
+
+func TestFetchHTTP10(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte("HTTP/1.0 200 OK\r\nContent-Type: image/jpeg\r\n\r\nold image"))
+	}()
+
+	image, err := newTestFetcher().Fetch(context.Background(), "http://"+l.Addr().String()+"/img.jpg", http.Header{})
+	require.NoError(t, err)
+	require.Equal(t, []byte("old image"), image.Data)
+}
+
+func TestFetchScheme(t *testing.T) {
+	_, err := newTestFetcher().Fetch(context.Background(), "ftp://example.com/img.jpg", http.Header{})
+	require.ErrorIs(t, err, utils.ErrNotSupportedScheme)
+}
+
+func TestFetchMaxSourceSize(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		if r.URL.Query().Get("chunked") == "" {
+			w.Header().Set("Content-Length", "10")
+		} else {
+			w.(http.Flusher).Flush()
+		}
+		_, _ = w.Write([]byte("0123456789"))
+	}))
+	defer origin.Close()
+
+	t.Run("within limit", func(t *testing.T) {
+		image, err := newTestFetcher(WithMaxSourceSize(10)).Fetch(context.Background(), origin.URL, http.Header{})
+		require.NoError(t, err)
+		require.Len(t, image.Data, 10)
+	})
+
+	t.Run("content length exceeds limit", func(t *testing.T) {
+		before := testutil.ToFloat64(rejectedDownloads)
+		_, err := newTestFetcher(WithMaxSourceSize(9)).Fetch(context.Background(), origin.URL, http.Header{})
+		require.ErrorIs(t, err, utils.ErrSourceTooLarge)
+		require.Equal(t, before+1, testutil.ToFloat64(rejectedDownloads))
+	})
+
+	t.Run("streamed body exceeds limit", func(t *testing.T) {
+		_, err := newTestFetcher(WithMaxSourceSize(9)).Fetch(context.Background(), origin.URL+"?chunked=1", http.Header{})
+		require.ErrorIs(t, err, utils.ErrSourceTooLarge)
+	})
+}
+
+func TestFetchMetricsHost(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		_, _ = w.Write([]byte("0123456789"))
+	}))
+	defer origin.Close()
+	host := strings.TrimPrefix(origin.URL, "http://")
+	listed, err := policy.NewOriginPolicy([]string{host}, nil)
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		fetcher *HTTPFetcher
+		label   string
+	}{
+		{newTestFetcher(WithOriginPolicy(listed)), host},
+		{newTestFetcher(), otherHost},
+	} {
+		before := testutil.ToFloat64(fetchBytes.WithLabelValues(tt.label))
+		_, err := tt.fetcher.Fetch(context.Background(), origin.URL, http.Header{})
+		require.NoError(t, err)
+		require.Equal(t, before+10, testutil.ToFloat64(fetchBytes.WithLabelValues(tt.label)), tt.label)
+	}
+}
+
+func TestFetchRedirects(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/img.jpg", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		_, _ = w.Write([]byte("image"))
+	})
+	mux.HandleFunc("/hop/", func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/hop/"))
+		if n == 0 {
+			http.Redirect(w, r, "/img.jpg", http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, "/hop/"+strconv.Itoa(n-1), http.StatusFound)
+	})
+	mux.HandleFunc("/external", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://localhost"+r.Host[strings.LastIndex(r.Host, ":"):]+"/img.jpg", http.StatusFound)
+	})
+	origin := httptest.NewServer(mux)
+	defer origin.Close()
+
+	t.Run("follows within limit", func(t *testing.T) {
+		image, err := newTestFetcher(WithMaxRedirects(3)).Fetch(context.Background(), origin.URL+"/hop/2", http.Header{})
+		require.NoError(t, err)
+		require.Equal(t, origin.URL+"/img.jpg", image.URL)
+		require.Equal(t, 3, image.Redirects)
+	})
+
+	t.Run("too many redirects", func(t *testing.T) {
+		_, err := newTestFetcher(WithMaxRedirects(2)).Fetch(context.Background(), origin.URL+"/hop/2", http.Header{})
+		require.ErrorIs(t, err, utils.ErrTooManyRedirects)
+	})
+
+	t.Run("following disabled", func(t *testing.T) {
+		_, err := newTestFetcher(WithMaxRedirects(0)).Fetch(context.Background(), origin.URL+"/hop/0", http.Header{})
+		require.ErrorIs(t, err, utils.ErrTooManyRedirects)
+	})
+
+	t.Run("hop rejected by origin policy", func(t *testing.T) {
+		op, err := policy.NewOriginPolicy([]string{strings.TrimPrefix(origin.URL, "http://")}, nil)
+		require.NoError(t, err)
+		_, err = newTestFetcher(WithOriginPolicy(op)).Fetch(context.Background(), origin.URL+"/external", http.Header{})
+		require.ErrorIs(t, err, utils.ErrOriginNotAllowed)
+	})
+
+	t.Run("hop rejected by ssrf protection", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.2:0")
+		if err != nil {
+			t.Skipf("no 127.0.0.2 loopback: %v", err)
+		}
+		internal := httptest.NewUnstartedServer(mux)
+		internal.Listener = l
+		internal.Start()
+		defer internal.Close()
+		redirector := httptest.NewServer(http.RedirectHandler(internal.URL+"/img.jpg", http.StatusFound))
+		defer redirector.Close()
+
+		allowed, err := ParseNetworks("127.0.0.1")
+		require.NoError(t, err)
+		f := NewFetcher(zap.NewNop().Sugar(), time.Second, time.Second, WithAllowedNetworks(allowed))
+		_, err = f.Fetch(context.Background(), redirector.URL, http.Header{})
+		require.ErrorIs(t, err, utils.ErrOriginNotAllowed)
+	})
+}
+
+func TestFetchPropagatesTraceContext(t *testing.T) {
+	defer otel.SetTextMapPropagator(otel.GetTextMapPropagator())
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	}))
+
+	var traceparent string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("Traceparent")
+		w.Header().Set("Content-Type", "image/jpeg")
+	}))
+	defer origin.Close()
+
+	_, err := newTestFetcher().Fetch(ctx, origin.URL+"/img.jpg", http.Header{})
+	require.NoError(t, err)
+	require.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", traceparent)
+}
+
+func TestFetchForwardsRequestID(t *testing.T) {
+	var forwarded []string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = append(forwarded, r.Header.Get(logging.RequestIDHeader))
+		w.Header().Set("Content-Type", "image/jpeg")
+	}))
+	defer origin.Close()
+	hp, err := NewHeaderPolicy([]string{logging.RequestIDHeader}, nil, nil)
+	require.NoError(t, err)
+	f := newTestFetcher(WithHeaderPolicy(hp))
+	clientHeader := http.Header{logging.RequestIDHeader: {"from-client"}}
+
+	_, err = f.Fetch(logging.WithRequestID(context.Background(), "req-1"), origin.URL, clientHeader)
+	require.NoError(t, err)
+	_, err = f.Fetch(context.Background(), origin.URL, clientHeader)
+	require.NoError(t, err)
+	require.Equal(t, []string{"req-1", ""}, forwarded)
+}
@@ -0,0 +1,127 @@
+package fetcher
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/bestleg/ImagePreviewer/pkg/services/policy"
+	"github.com/pkg/errors"
+)
+
+var (
+	// DefaultForwardHeaders are client headers forwarded when no allowlist is configured.
+	// Cookie and Authorization are deliberately absent.
+	DefaultForwardHeaders = []string{"Accept", "Accept-Language"}
+	// DefaultSetHeaders are injected into every origin request when none are configured.
+	DefaultSetHeaders = map[string]string{"User-Agent": "image-previewer"}
+
+	// neverForward lists hop-by-hop headers and headers the fetcher handles itself.
+	neverForward = canonicalSet([]string{
+		"Accept-Encoding", "Connection", "Content-Length", "Host", "Keep-Alive", "Proxy-Connection",
+		"TE", "Trailer", "Transfer-Encoding", "Upgrade", "X-Request-ID",
+	})
+)
+
+// HeaderRule overrides the forwarding policy for origins matching Origins patterns,
+// see policy.NewOriginPolicy for the pattern format.
+type HeaderRule struct {
+	Origins []string
+	Forward []string
+	Set     map[string]string
+}
+
+// HeaderPolicy builds origin request headers from an allowlist of client
+// headers and static headers injected by the service.
+type HeaderPolicy struct {
+	forward map[string]struct{}
+	set     http.Header
+	rules   []headerRule
+}
+
+type headerRule struct {
+	origins *policy.OriginPolicy
+	forward map[string]struct{}
+	set     http.Header
+}
+
+// NewHeaderPolicy creates a HeaderPolicy, the first matching rule extends the
+// forwarded headers and overrides the injected ones.
+func NewHeaderPolicy(forward []string, set map[string]string, rules []HeaderRule) (*HeaderPolicy, error) {
+	hp := &HeaderPolicy{
+		forward: canonicalSet(forward),
+		set:     toHeader(set),
+		rules:   make([]headerRule, 0, len(rules)),
+	}
+	for i, r := range rules {
+		// An empty pattern list allows every origin, which would silently replace the defaults.
+		if len(r.Origins) == 0 {
+			return nil, errors.Errorf("header rule #%d has no origins to match", i+1)
+		}
+		origins, err := policy.NewOriginPolicy(r.Origins, nil)
+		if err != nil {
+			return nil, err
+		}
+		hp.rules = append(hp.rules, headerRule{
+			origins: origins,
+			forward: canonicalSet(r.Forward),
+			set:     toHeader(r.Set),
+		})
+	}
+	return hp, nil
+}
+
+func defaultHeaderPolicy() *HeaderPolicy {
+	hp, _ := NewHeaderPolicy(DefaultForwardHeaders, DefaultSetHeaders, nil)
+	return hp
+}
+
+// Apply returns headers to send to the origin for the client request headers.
+func (hp *HeaderPolicy) Apply(origin *url.URL, clientHeader http.Header) http.Header {
+	var rule *headerRule
+	for i := range hp.rules {
+		if hp.rules[i].origins.Allowed(origin) {
+			rule = &hp.rules[i]
+			break
+		}
+	}
+
+	header := make(http.Header)
+	for name, values := range clientHeader {
+		name = http.CanonicalHeaderKey(name)
+		if _, never := neverForward[name]; never {
+			continue
+		}
+		_, ok := hp.forward[name]
+		if !ok && rule != nil {
+			_, ok = rule.forward[name]
+		}
+		if ok {
+			header[name] = append([]string(nil), values...)
+		}
+	}
+	for name, values := range hp.set {
+		header[name] = values
+	}
+	if rule != nil {
+		for name, values := range rule.set {
+			header[name] = values
+		}
+	}
+	return header
+}
+
+func canonicalSet(names []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		set[http.CanonicalHeaderKey(name)] = struct{}{}
+	}
+	return set
+}
+
+func toHeader(values map[string]string) http.Header {
+	header := make(http.Header, len(values))
+	for name, value := range values {
+		header.Set(name, value)
+	}
+	return header
+}
@@ -0,0 +1,75 @@
+package fetcher
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeaderPolicy(t *testing.T) {
+	hp, err := NewHeaderPolicy(
+		[]string{"accept", "Accept-Encoding"},
+		map[string]string{"User-Agent": "previewer"},
+		[]HeaderRule{{
+			Origins: []string{"*.partner.com"},
+			Forward: []string{"Referer"},
+			Set:     map[string]string{"User-Agent": "partner-previewer", "X-Partner": "1"},
+		}},
+	)
+	require.NoError(t, err)
+
+	client := http.Header{
+		"Accept":          {"image/*"},
+		"Accept-Encoding": {"gzip"},
+		"Authorization":   {"Bearer secret"},
+		"Cookie":          {"session=1"},
+		"Referer":         {"http://site.com"},
+		"User-Agent":      {"browser"},
+	}
+
+	t.Run("default origin", func(t *testing.T) {
+		header := hp.Apply(&url.URL{Host: "example.com"}, client)
+		require.Equal(t, http.Header{
+			"Accept":     {"image/*"},
+			"User-Agent": {"previewer"},
+		}, header)
+	})
+
+	t.Run("matching rule", func(t *testing.T) {
+		header := hp.Apply(&url.URL{Host: "img.partner.com"}, client)
+		require.Equal(t, http.Header{
+			"Accept":     {"image/*"},
+			"Referer":    {"http://site.com"},
+			"User-Agent": {"partner-previewer"},
+			"X-Partner":  {"1"},
+		}, header)
+	})
+}
+
+func TestHeaderRulesRequireOrigins(t *testing.T) {
+	_, err := NewHeaderPolicy(nil, nil, []HeaderRule{{Forward: []string{"Cookie"}}})
+	require.Error(t, err)
+}
+
+func TestFetchStripsSensitiveHeaders(t *testing.T) {
+	var received http.Header
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		w.Header().Set("Content-Type", "image/jpeg")
+	}))
+	defer origin.Close()
+
+	client := http.Header{"Cookie": {"session=1"}, "Authorization": {"Basic x"}, "Accept": {"image/jpeg"}}
+	_, err := newTestFetcher().Fetch(context.Background(), origin.URL, client)
+	require.NoError(t, err)
+
+	require.Empty(t, received.Get("Cookie"))
+	require.Empty(t, received.Get("Authorization"))
+	require.Equal(t, "image/jpeg", received.Get("Accept"))
+	require.Equal(t, DefaultSetHeaders["User-Agent"], received.Get("User-Agent"))
+	require.Len(t, client, 3, "client headers must not be modified")
+}
@@ -0,0 +1,124 @@
+package fetcher
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/bestleg/ImagePreviewer/pkg/utils"
+	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
+)
+
+// idleHostTTL is how long limits of a host without requests are kept.
+const idleHostTTL = time.Minute
+
+// HostLimits bound the load put on a single origin host.
+type HostLimits struct {
+	// MaxConcurrent is the number of simultaneous fetches, zero means unlimited.
+	MaxConcurrent int
+	// QueueTimeout is how long a fetch may wait for a free slot or a rate token.
+	QueueTimeout time.Duration
+	// RateLimit is the number of requests per second, zero means unlimited.
+	RateLimit float64
+	// RateBurst is the number of requests allowed above RateLimit at once.
+	RateBurst int
+}
+
+type hostLimiter struct {
+	limits HostLimits
+
+	mu        sync.Mutex
+	hosts     map[string]*hostSlot
+	lastSweep time.Time
+}
+
+type hostSlot struct {
+	sem      chan struct{}
+	limiter  *rate.Limiter
+	refs     int
+	lastUsed time.Time
+}
+
+func newHostLimiter(limits HostLimits) *hostLimiter {
+	if limits.MaxConcurrent <= 0 && limits.RateLimit <= 0 {
+		return nil
+	}
+	return &hostLimiter{limits: limits, hosts: make(map[string]*hostSlot)}
+}
+
+// acquire waits in the host queue for a concurrency slot and a rate token,
+// the returned function releases the slot.
+func (l *hostLimiter) acquire(ctx context.Context, host string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	slot := l.slot(host)
+	release := func() { l.release(host, slot) }
+
+	if l.limits.QueueTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.limits.QueueTimeout)
+		defer cancel()
+	}
+	if slot.limiter != nil {
+		if err := slot.limiter.Wait(ctx); err != nil {
+			release()
+			return nil, errors.Wrapf(utils.ErrOriginBusy, "rate limit of %s: %v", host, err)
+		}
+	}
+	if slot.sem != nil {
+		select {
+		case slot.sem <- struct{}{}:
+		case <-ctx.Done():
+			release()
+			return nil, errors.Wrapf(utils.ErrOriginBusy, "no free connection slot for %s", host)
+		}
+		return func() {
+			<-slot.sem
+			release()
+		}, nil
+	}
+	return release, nil
+}
+
+func (l *hostLimiter) slot(host string) *hostSlot {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) > idleHostTTL {
+		l.lastSweep = now
+		for h, s := range l.hosts {
+			if s.refs == 0 && now.Sub(s.lastUsed) > idleHostTTL {
+				delete(l.hosts, h)
+			}
+		}
+	}
+
+	s, ok := l.hosts[host]
+	if !ok {
+		s = &hostSlot{}
+		if l.limits.MaxConcurrent > 0 {
+			s.sem = make(chan struct{}, l.limits.MaxConcurrent)
+		}
+		if l.limits.RateLimit > 0 {
+			burst := l.limits.RateBurst
+			if burst < 1 {
+				burst = 1
+			}
+			s.limiter = rate.NewLimiter(rate.Limit(l.limits.RateLimit), burst)
+		}
+		l.hosts[host] = s
+	}
+	s.refs++
+	s.lastUsed = now
+	return s
+}
+
+func (l *hostLimiter) release(host string, s *hostSlot) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s.refs--
+	s.lastUsed = time.Now()
+}
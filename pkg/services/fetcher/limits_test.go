@@ -0,0 +1,77 @@
+package fetcher
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bestleg/ImagePreviewer/pkg/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostLimiterConcurrency(t *testing.T) {
+	l := newHostLimiter(HostLimits{MaxConcurrent: 1, QueueTimeout: 20 * time.Millisecond})
+
+	release, err := l.acquire(context.Background(), "a.test")
+	require.NoError(t, err)
+
+	_, err = l.acquire(context.Background(), "a.test")
+	require.ErrorIs(t, err, utils.ErrOriginBusy, "queue timeout")
+
+	other, err := l.acquire(context.Background(), "b.test")
+	require.NoError(t, err, "hosts are limited separately")
+	other()
+
+	release()
+	release, err = l.acquire(context.Background(), "a.test")
+	require.NoError(t, err)
+	release()
+	require.Zero(t, l.hosts["a.test"].refs)
+}
+
+func TestHostLimiterRate(t *testing.T) {
+	l := newHostLimiter(HostLimits{RateLimit: 1, RateBurst: 2, QueueTimeout: 10 * time.Millisecond})
+	for i := 0; i < 2; i++ {
+		release, err := l.acquire(context.Background(), "a.test")
+		require.NoError(t, err)
+		release()
+	}
+	_, err := l.acquire(context.Background(), "a.test")
+	require.ErrorIs(t, err, utils.ErrOriginBusy)
+
+	require.Nil(t, newHostLimiter(HostLimits{}), "no limits configured")
+}
+
+func TestFetchHostConcurrency(t *testing.T) {
+	var current, peak int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&current, 1)
+		defer atomic.AddInt32(&current, -1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		w.Header().Set("Content-Type", "image/jpeg")
+	}))
+	defer origin.Close()
+
+	f := newTestFetcher(WithHostLimits(HostLimits{MaxConcurrent: 2, QueueTimeout: time.Second}))
+	const requests = 8
+	errs := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		go func() {
+			_, err := f.Fetch(context.Background(), origin.URL, http.Header{})
+			errs <- err
+		}()
+	}
+	for i := 0; i < requests; i++ {
+		require.NoError(t, <-errs)
+	}
+	require.LessOrEqual(t, atomic.LoadInt32(&peak), int32(2))
+}
@@ -0,0 +1,57 @@
+package fetcher
+
+import (
+	"net/url"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	fetchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "image_previewer",
+		Subsystem: "fetcher",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of origin requests including the body download, per attempt.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"host", "result"})
+	fetchBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "image_previewer",
+		Subsystem: "fetcher",
+		Name:      "received_bytes_total",
+		Help:      "Bytes of images downloaded from origins.",
+	}, []string{"host"})
+	rejectedDownloads = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "image_previewer",
+		Subsystem: "fetcher",
+		Name:      "rejected_downloads_total",
+		Help:      "Origin responses dropped for exceeding the source size limit.",
+	})
+	// breakerStates counts non-closed breakers, hosts not listed by the
+	// origin policy are counted together like in the other fetcher metrics.
+	breakerStates = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "image_previewer",
+		Subsystem: "fetcher",
+		Name:      "circuit_breakers",
+		Help:      "Open and half-open circuit breakers of origin hosts.",
+	}, []string{"host", "state"})
+)
+
+// otherHost labels metrics of origins not listed by the origin policy,
+// clients choose hosts so labelling them as is would be unbounded.
+const otherHost = "other"
+
+func (f *HTTPFetcher) metricHost(u *url.URL) string {
+	if f.originPolicy.Listed(u) {
+		return u.Host
+	}
+	return otherHost
+}
+
+// breakerHost labels breakers, which exist per host regardless of the path.
+func (f *HTTPFetcher) breakerHost(host string) string {
+	if f.originPolicy.ListedHost(host) {
+		return host
+	}
+	return otherHost
+}
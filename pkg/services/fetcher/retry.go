@@ -0,0 +1,115 @@
+package fetcher
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bestleg/ImagePreviewer/pkg/utils"
+	"github.com/pkg/errors"
+)
+
+// maxRetryDelay caps the exponential backoff, Retry-After may ask for more.
+const maxRetryDelay = 5 * time.Second
+
+// isRetryable reports whether the failed GET may succeed when repeated:
+// connection failures and statuses signalling a temporary overload.
+func isRetryable(err error) bool {
+	var upstream *utils.UpstreamStatusError
+	if errors.As(err, &upstream) {
+		switch upstream.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return false
+	}
+	if errors.Is(err, context.Canceled) || isTimeout(err) ||
+		errors.Is(err, utils.ErrOriginNotAllowed) ||
+		errors.Is(err, utils.ErrTooManyRedirects) ||
+		errors.Is(err, utils.ErrNotSupportedScheme) {
+		return false
+	}
+	return errors.Is(err, utils.ErrFailedToPerformRequest) || errors.Is(err, utils.ErrFailedToReadRequestBody)
+}
+
+// classifyOutcome tells the circuit breaker whether the origin looks unhealthy.
+// Every 5xx status is a failure. 429 is deliberately neutral: the origin is up
+// but throttles us, retries already honor its Retry-After, while an open breaker
+// would reject requests of all clients for the whole cooldown.
+func classifyOutcome(err error) outcome {
+	var upstream *utils.UpstreamStatusError
+	switch {
+	case err == nil:
+		return outcomeSuccess
+	case errors.Is(err, context.Canceled):
+		return outcomeNeutral
+	case errors.As(err, &upstream):
+		switch {
+		case upstream.StatusCode >= http.StatusInternalServerError:
+			return outcomeFailure
+		case upstream.StatusCode == http.StatusTooManyRequests:
+			return outcomeNeutral
+		}
+		return outcomeSuccess
+	case isRetryable(err) || isTimeout(err):
+		return outcomeFailure
+	default:
+		return outcomeSuccess
+	}
+}
+
+// waitRetry sleeps before the next attempt, it gives up when the delay
+// doesn't fit into the remaining request time or the context is done.
+func (f *HTTPFetcher) waitRetry(ctx context.Context, attempt int, err error) bool {
+	delay := f.backoff(attempt)
+	var upstream *utils.UpstreamStatusError
+	if errors.As(err, &upstream) && upstream.RetryAfter > 0 {
+		delay = upstream.RetryAfter
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+		return false
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// backoff returns a random delay up to retryDelay*2^(attempt-1), the "full jitter" strategy.
+func (f *HTTPFetcher) backoff(attempt int) time.Duration {
+	if f.retryDelay <= 0 {
+		return 0
+	}
+	ceiling := f.retryDelay << (attempt - 1)
+	if ceiling <= 0 || ceiling > maxRetryDelay {
+		ceiling = maxRetryDelay
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1)) //nolint:gosec
+}
+
+// parseRetryAfter parses both forms of Retry-After: delay seconds and HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
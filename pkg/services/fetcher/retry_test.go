@@ -0,0 +1,118 @@
+package fetcher
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bestleg/ImagePreviewer/pkg/utils"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetchRetries(t *testing.T) {
+	newOrigin := func(failures int32, status int, retryAfter string) (*httptest.Server, *int32) {
+		var calls int32
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&calls, 1) <= failures {
+				w.Header().Set("Retry-After", retryAfter)
+				w.WriteHeader(status)
+				return
+			}
+			w.Header().Set("Content-Type", "image/jpeg")
+		})), &calls
+	}
+
+	t.Run("recovers from transient status", func(t *testing.T) {
+		origin, calls := newOrigin(2, http.StatusServiceUnavailable, "")
+		defer origin.Close()
+
+		_, err := newTestFetcher(WithRetries(3, time.Millisecond)).Fetch(context.Background(), origin.URL, http.Header{})
+		require.NoError(t, err)
+		require.Equal(t, int32(3), atomic.LoadInt32(calls))
+	})
+
+	t.Run("gives up after max attempts", func(t *testing.T) {
+		origin, calls := newOrigin(5, http.StatusTooManyRequests, "")
+		defer origin.Close()
+
+		_, err := newTestFetcher(WithRetries(2, time.Millisecond)).Fetch(context.Background(), origin.URL, http.Header{})
+		require.ErrorIs(t, err, utils.ErrOriginBadStatus)
+		require.Equal(t, int32(2), atomic.LoadInt32(calls))
+	})
+
+	t.Run("does not retry permanent errors", func(t *testing.T) {
+		origin, calls := newOrigin(1, http.StatusNotFound, "")
+		defer origin.Close()
+
+		_, err := newTestFetcher(WithRetries(3, time.Millisecond)).Fetch(context.Background(), origin.URL, http.Header{})
+		require.ErrorIs(t, err, utils.ErrOriginNotFound)
+		require.Equal(t, int32(1), atomic.LoadInt32(calls))
+	})
+
+	t.Run("retry after beyond request timeout", func(t *testing.T) {
+		origin, calls := newOrigin(1, http.StatusServiceUnavailable, "120")
+		defer origin.Close()
+
+		start := time.Now()
+		_, err := newTestFetcher(WithRetries(3, time.Millisecond)).Fetch(context.Background(), origin.URL, http.Header{})
+		require.ErrorIs(t, err, utils.ErrOriginBadStatus)
+		require.Equal(t, int32(1), atomic.LoadInt32(calls))
+		require.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("retries connection errors", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		var accepted int32
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				atomic.AddInt32(&accepted, 1)
+				conn.Close()
+			}
+		}()
+		defer l.Close()
+
+		_, err = newTestFetcher(WithRetries(3, time.Millisecond)).Fetch(context.Background(), "http://"+l.Addr().String(), http.Header{})
+		require.ErrorIs(t, err, utils.ErrFailedToPerformRequest)
+		require.Equal(t, int32(3), atomic.LoadInt32(&accepted))
+	})
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+	require.Equal(t, 5*time.Second, parseRetryAfter("5", now))
+	require.Equal(t, 30*time.Second, parseRetryAfter("Fri, 01 Oct 2021 12:00:30 GMT", now))
+	require.Zero(t, parseRetryAfter("Fri, 01 Oct 2021 11:00:00 GMT", now))
+	require.Zero(t, parseRetryAfter("soon", now))
+	require.Zero(t, parseRetryAfter("", now))
+}
+
+func TestClassifyOutcome(t *testing.T) {
+	status := func(code int) error {
+		return utils.WithKind(utils.ErrOriginBadStatus, &utils.UpstreamStatusError{StatusCode: code})
+	}
+	tests := []struct {
+		err     error
+		outcome outcome
+	}{
+		{nil, outcomeSuccess},
+		{status(http.StatusNotFound), outcomeSuccess},
+		{status(http.StatusTooManyRequests), outcomeNeutral},
+		{status(http.StatusInternalServerError), outcomeFailure},
+		{status(http.StatusServiceUnavailable), outcomeFailure},
+		{errors.Wrap(context.Canceled, "request abandoned"), outcomeNeutral},
+		{utils.WithKind(utils.ErrFailedToPerformRequest, errors.New("connection refused")), outcomeFailure},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.outcome, classifyOutcome(tt.err), "%v", tt.err)
+	}
+}
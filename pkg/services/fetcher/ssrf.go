@@ -0,0 +1,101 @@
+package fetcher
+
+import (
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/bestleg/ImagePreviewer/pkg/utils"
+	"github.com/pkg/errors"
+)
+
+// blockedNets are special purpose ranges not covered by the net.IP helpers.
+var blockedNets = mustParseNetworks(
+	"0.0.0.0/8",     // "this" network
+	"100.64.0.0/10", // carrier-grade NAT, used by some cloud metadata services
+	"192.0.0.0/24",  // IETF protocol assignments
+	"198.18.0.0/15", // benchmarking
+	"240.0.0.0/4",   // reserved
+	"64:ff9b::/96",  // NAT64, may translate to any IPv4 address
+)
+
+// addressFilter rejects connections to loopback, link-local, private and
+// other internal addresses unless they are explicitly allowed.
+type addressFilter struct {
+	allowed []*net.IPNet
+}
+
+func (a addressFilter) control(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse dial address")
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return errors.Errorf("failed to parse dial address %q", address)
+	}
+	if !a.isAllowed(ip) {
+		return errors.Wrapf(utils.ErrOriginNotAllowed, "address %s is blocked", ip)
+	}
+	return nil
+}
+
+func (a addressFilter) isAllowed(ip net.IP) bool {
+	for _, n := range a.allowed {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return !isInternal(ip)
+}
+
+func isInternal(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+	for _, n := range blockedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseNetworks parses a comma separated list of CIDRs and single IP addresses.
+func ParseNetworks(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, errors.Errorf("invalid ip address %q", item)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid network %q", item)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func mustParseNetworks(list ...string) []*net.IPNet {
+	nets, err := ParseNetworks(strings.Join(list, ","))
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
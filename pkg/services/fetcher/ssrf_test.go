@@ -0,0 +1,67 @@
+package fetcher
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bestleg/ImagePreviewer/pkg/utils"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestIsInternal(t *testing.T) {
+	for _, addr := range []string{
+		"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254",
+		"100.100.100.200", "0.0.0.0", "::1", "fd00:ec2::254", "fe80::1", "::ffff:127.0.0.1",
+	} {
+		require.True(t, isInternal(net.ParseIP(addr)), addr)
+	}
+	for _, addr := range []string{"8.8.8.8", "93.184.216.34", "2606:4700:4700::1111"} {
+		require.False(t, isInternal(net.ParseIP(addr)), addr)
+	}
+}
+
+func TestParseNetworks(t *testing.T) {
+	nets, err := ParseNetworks(" 10.0.0.0/8, 127.0.0.1,::1 ,")
+	require.NoError(t, err)
+	require.Len(t, nets, 3)
+	require.True(t, nets[0].Contains(net.ParseIP("10.20.30.40")))
+	require.True(t, nets[1].Contains(net.ParseIP("127.0.0.1")))
+	require.False(t, nets[1].Contains(net.ParseIP("127.0.0.2")))
+	require.True(t, nets[2].Contains(net.ParseIP("::1")))
+
+	_, err = ParseNetworks("10.0.0.0/33")
+	require.Error(t, err)
+	_, err = ParseNetworks("localhost")
+	require.Error(t, err)
+}
+
+func TestFetchBlocksInternalAddresses(t *testing.T) {
+	var hits int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("Content-Type", "image/jpeg")
+	}))
+	defer origin.Close()
+	port := origin.URL[strings.LastIndex(origin.URL, ":"):]
+
+	f := NewFetcher(zap.NewNop().Sugar(), time.Second, time.Second)
+	for _, host := range []string{"127.0.0.1", "localhost"} {
+		_, err := f.Fetch(context.Background(), "http://"+host+port+"/img.jpg", http.Header{})
+		require.ErrorIs(t, err, utils.ErrOriginNotAllowed, host)
+	}
+	require.Zero(t, atomic.LoadInt32(&hits))
+
+	allowed, err := ParseNetworks("127.0.0.1")
+	require.NoError(t, err)
+	f = NewFetcher(zap.NewNop().Sugar(), time.Second, time.Second, WithAllowedNetworks(allowed))
+	_, err = f.Fetch(context.Background(), origin.URL+"/img.jpg", http.Header{})
+	require.NoError(t, err)
+	require.Equal(t, int32(1), atomic.LoadInt32(&hits))
+}
@@ -0,0 +1,205 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bestleg/ImagePreviewer/pkg/services/fetcher"
+	"github.com/pkg/errors"
+)
+
+const (
+	statusOK   = "ok"
+	statusFail = "fail"
+)
+
+// Check reports a problem making the service unable to serve requests.
+type Check func(ctx context.Context) error
+
+// Checker runs named checks and reports their results as JSON.
+type Checker struct {
+	timeout time.Duration
+
+	mu     sync.RWMutex
+	names  []string
+	checks map[string]Check
+}
+
+// Report is the JSON body of a health endpoint.
+type Report struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+// CheckResult is the outcome of a single check.
+type CheckResult struct {
+	Status     string  `json:"status"`
+	Error      string  `json:"error,omitempty"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+// NewChecker runs all checks concurrently, each bounded by timeout.
+func NewChecker(timeout time.Duration) *Checker {
+	return &Checker{timeout: timeout, checks: make(map[string]Check)}
+}
+
+// Add registers a check, replacing the one with the same name.
+func (c *Checker) Add(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.checks[name]; !ok {
+		c.names = append(c.names, name)
+	}
+	c.checks[name] = check
+}
+
+// Run runs all checks, the report fails if any of them does.
+func (c *Checker) Run(ctx context.Context) Report {
+	c.mu.RLock()
+	names := append([]string(nil), c.names...)
+	checks := make([]Check, len(names))
+	for i, name := range names {
+		checks[i] = c.checks[name]
+	}
+	c.mu.RUnlock()
+
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	results := make([]CheckResult, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			results[i] = run(ctx, check)
+		}(i, check)
+	}
+	wg.Wait()
+
+	report := Report{Status: statusOK, Checks: make(map[string]CheckResult, len(names))}
+	for i, name := range names {
+		report.Checks[name] = results[i]
+		if results[i].Status != statusOK {
+			report.Status = statusFail
+		}
+	}
+	return report
+}
+
+func run(ctx context.Context, check Check) CheckResult {
+	start := time.Now()
+	err := check(ctx)
+	result := CheckResult{Status: statusOK, DurationMS: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		result.Status = statusFail
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// ServeHTTP responds with the report, 503 Service Unavailable if any check fails.
+func (c *Checker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, c.Run(r.Context()))
+}
+
+// StatusHandler responds like the Checker but without results of single
+// checks, their errors may reveal paths and addresses to the public.
+func (c *Checker) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeReport(w, Report{Status: c.Run(r.Context()).Status})
+	})
+}
+
+func writeReport(w http.ResponseWriter, report Report) {
+	status := http.StatusOK
+	if report.Status != statusOK {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(report)
+}
+
+// Cached runs check at most once per interval and returns its last result in
+// between, so that frequent probes don't repeat a costly check. A run cut short
+// by ctx is not remembered.
+func Cached(check Check, interval time.Duration) Check {
+	var (
+		mu      sync.Mutex
+		lastRun time.Time
+		lastErr error
+	)
+	return func(ctx context.Context) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if !lastRun.IsZero() && time.Since(lastRun) < interval {
+			return lastErr
+		}
+		err := check(ctx)
+		if ctx.Err() == nil {
+			lastRun, lastErr = time.Now(), err
+		}
+		return err
+	}
+}
+
+// DirWritable checks that a file can be created in dir.
+func DirWritable(dir string) Check {
+	return func(context.Context) error {
+		f, err := ioutil.TempFile(dir, ".readyz-")
+		if err != nil {
+			return errors.Wrap(err, "cache dir is not writable")
+		}
+		name := f.Name()
+		if err := f.Close(); err != nil {
+			return err
+		}
+		return os.Remove(name)
+	}
+}
+
+// FreeDiskSpace checks that the file system of dir has at least minFree bytes available.
+func FreeDiskSpace(dir string, minFree uint64) Check {
+	return func(context.Context) error {
+		free, err := freeDiskSpace(dir)
+		if err != nil {
+			return errors.Wrap(err, "failed to get free disk space")
+		}
+		if free < minFree {
+			return errors.Errorf("%d bytes free, %d required", free, minFree)
+		}
+		return nil
+	}
+}
+
+// Saturation is implemented by worker pools which may run out of capacity.
+type Saturation interface {
+	Saturated() bool
+}
+
+// NotSaturated checks that the pool accepts new jobs.
+func NotSaturated(pool Saturation) Check {
+	return func(context.Context) error {
+		if pool.Saturated() {
+			return errors.New("worker pool queue is full")
+		}
+		return nil
+	}
+}
+
+// OriginReachable checks that the canary image at url can be fetched.
+func OriginReachable(f fetcher.Fetcher, url string) Check {
+	return func(ctx context.Context) error {
+		_, err := f.Fetch(ctx, url, http.Header{})
+		return err
+	}
+}
@@ -0,0 +1,85 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChecker(t *testing.T) {
+	c := NewChecker(time.Second)
+	c.Add("ok", func(context.Context) error { return nil })
+
+	w := httptest.NewRecorder()
+	c.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	c.Add("broken", func(context.Context) error { return errors.New("broken") })
+	c.Add("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	c.timeout = 10 * time.Millisecond
+	w = httptest.NewRecorder()
+	c.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	var report Report
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	require.Equal(t, statusFail, report.Status)
+	require.Equal(t, statusOK, report.Checks["ok"].Status)
+	require.Equal(t, statusFail, report.Checks["broken"].Status)
+	require.Equal(t, "broken", report.Checks["broken"].Error)
+	require.Equal(t, context.DeadlineExceeded.Error(), report.Checks["slow"].Error)
+
+	w = httptest.NewRecorder()
+	c.StatusHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.JSONEq(t, `{"status":"fail"}`, w.Body.String())
+}
+
+func TestCached(t *testing.T) {
+	var runs int
+	check := Cached(func(context.Context) error {
+		runs++
+		return errors.New("unreachable")
+	}, time.Hour)
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Error(t, check(canceled))
+	require.Error(t, check(context.Background()))
+	require.Error(t, check(context.Background()))
+	require.Equal(t, 2, runs, "canceled run is not remembered")
+}
+
+func TestDirChecks(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	require.NoError(t, DirWritable(dir)(ctx))
+	require.Error(t, DirWritable(filepath.Join(dir, "missing"))(ctx))
+
+	require.NoError(t, FreeDiskSpace(dir, 1)(ctx))
+	require.Error(t, FreeDiskSpace(dir, math.MaxUint64)(ctx))
+}
+
+type saturation bool
+
+func (s saturation) Saturated() bool {
+	return bool(s)
+}
+
+func TestNotSaturated(t *testing.T) {
+	require.NoError(t, NotSaturated(saturation(false))(context.Background()))
+	require.Error(t, NotSaturated(saturation(true))(context.Background()))
+}
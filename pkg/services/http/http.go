@@ -9,7 +9,11 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/bestleg/ImagePreviewer/pkg/services/health"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 )
 
@@ -18,6 +22,16 @@ var (
 	readyLock sync.RWMutex
 )
 
+// readinessTimeout bounds all readiness checks together.
+const readinessTimeout = 3 * time.Second
+
+var inFlight = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: "image_previewer",
+	Subsystem: "http",
+	Name:      "requests_in_flight",
+	Help:      "Requests being served by the application handler.",
+})
+
 func setReady(state bool) {
 	readyLock.Lock()
 	defer readyLock.Unlock()
@@ -31,9 +45,14 @@ func isReady() bool {
 }
 
 type Server struct {
-	Server          *http.Server
+	Server *http.Server
+	// Admin serves operator endpoints on a separate, usually loopback, address.
+	Admin           *http.Server
+	adminMux        *http.ServeMux
+	readiness       *health.Checker
 	shutdownTimeout time.Duration
 	done            chan struct{}
+	adminDone       chan struct{}
 }
 
 type StartStopper interface {
@@ -41,9 +60,12 @@ type StartStopper interface {
 	Stop(logger *zap.SugaredLogger)
 }
 
-func NewHTTPServer(addr string, shutdownTimeout time.Duration, router http.Handler) *Server {
+// NewHTTPServer serves router on addr and admin endpoints on adminAddr,
+// an empty adminAddr disables them.
+func NewHTTPServer(addr, adminAddr string, shutdownTimeout time.Duration, router http.Handler) *Server {
 	r := http.NewServeMux()
-	r.Handle("/", router)
+	r.Handle("/", promhttp.InstrumentHandlerInFlight(inFlight, router))
+	r.Handle("/metrics", promhttp.Handler())
 	r.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
 		if isReady() {
 			w.WriteHeader(http.StatusOK)
@@ -51,17 +73,50 @@ func NewHTTPServer(addr string, shutdownTimeout time.Duration, router http.Handl
 		}
 		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
 	})
+	// The process is alive as long as it answers, there is nothing to check.
+	r.Handle("/livez", health.NewChecker(0))
+	readiness := health.NewChecker(readinessTimeout)
+	readiness.Add("server", func(context.Context) error {
+		if !isReady() {
+			return errors.New("server is starting or shutting down")
+		}
+		return nil
+	})
+	// Results of single checks are reported on the admin address only.
+	r.Handle("/readyz", readiness.StatusHandler())
 
 	srv := &http.Server{
 		Addr:    addr,
 		Handler: r,
 	}
 
-	return &Server{
+	s := &Server{
 		shutdownTimeout: shutdownTimeout,
 		Server:          srv,
+		readiness:       readiness,
 		done:            make(chan struct{}),
 	}
+	if adminAddr != "" {
+		s.adminMux = http.NewServeMux()
+		s.adminMux.Handle("/readyz", readiness)
+		s.Admin = &http.Server{Addr: adminAddr, Handler: s.adminMux}
+		s.adminDone = make(chan struct{})
+	}
+	return s
+}
+
+// HandleAdmin serves an operator endpoint on the admin address only,
+// it is not served at all when the admin address is disabled.
+func (s *Server) HandleAdmin(pattern string, handler http.Handler) {
+	if s.adminMux != nil {
+		s.adminMux.Handle(pattern, handler)
+	}
+}
+
+// AddReadinessCheck makes /readyz fail while check does, the failure
+// itself is described on the admin address only.
+func (s *Server) AddReadinessCheck(name string, check health.Check) {
+	s.readiness.Add(name, check)
 }
 
 func (s *Server) Run(logger *zap.SugaredLogger, appName string) {
@@ -96,6 +151,17 @@ func (s *Server) start(logger *zap.SugaredLogger) {
 		}
 		logger.Infof("http server on %s stopped listening", s.Server.Addr)
 	}()
+	if s.Admin == nil {
+		return
+	}
+	logger.Infof("starting admin http server on %s", s.Admin.Addr)
+	go func() {
+		defer close(s.adminDone)
+
+		if err := s.Admin.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			logger.Fatalf("admin http server failure: %v", err)
+		}
+	}()
 }
 
 func (s *Server) stop(logger *zap.SugaredLogger) {
@@ -105,5 +171,11 @@ func (s *Server) stop(logger *zap.SugaredLogger) {
 	}
 	logger.Infof("http server on %s stopped", s.Server.Addr)
 	<-s.done
+	if s.Admin != nil {
+		if err := s.Admin.Shutdown(ctx); err != nil {
+			logger.Errorf("admin http shutdown error :%v", err)
+		}
+		<-s.adminDone
+	}
 	cancel()
 }
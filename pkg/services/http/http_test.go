@@ -0,0 +1,44 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminEndpointsArePrivate(t *testing.T) {
+	app := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	admin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	s := NewHTTPServer(":0", "127.0.0.1:0", time.Second, app)
+	s.HandleAdmin("/admin/log-level", admin)
+	for _, path := range []string{"/admin/log-level", "/debug/vars"} {
+		w := httptest.NewRecorder()
+		s.Server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodPut, path, nil))
+		require.Equal(t, http.StatusTeapot, w.Code, "%s is left to the application", path)
+	}
+	w := httptest.NewRecorder()
+	s.Admin.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/admin/log-level", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	s.AddReadinessCheck("cache_dir", func(context.Context) error { return errors.New("/var/cache is read-only") })
+	w = httptest.NewRecorder()
+	s.Server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.NotContains(t, w.Body.String(), "/var/cache", "public report has no check details")
+	w = httptest.NewRecorder()
+	s.Admin.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.Contains(t, w.Body.String(), "/var/cache")
+
+	s = NewHTTPServer(":0", "", time.Second, app)
+	s.HandleAdmin("/admin/log-level", admin)
+	require.Nil(t, s.Admin)
+}
@@ -0,0 +1,178 @@
+package policy
+
+import (
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// OriginPolicy decides which origin URLs may be fetched.
+type OriginPolicy struct {
+	allow []pattern
+	deny  []pattern
+}
+
+// pattern matches a host, a wildcard subdomain or a host with a path prefix:
+// "example.com", "*.example.com", "example.com:8080/images/".
+type pattern struct {
+	host     string
+	wildcard bool
+	// port is empty when the pattern has none, it then matches the default
+	// port of the URL scheme, or any port if anyPort is set.
+	port    string
+	anyPort bool
+	prefix  string
+}
+
+// NewOriginPolicy builds a policy from allow and deny patterns. Deny patterns
+// take precedence, and an empty allow list allows every origin not denied.
+// An allow pattern without a port allows only the default port of the scheme,
+// while a deny pattern without a port denies every port.
+func NewOriginPolicy(allow, deny []string) (*OriginPolicy, error) {
+	p := &OriginPolicy{}
+	var err error
+	if p.allow, err = parsePatterns(allow, false); err != nil {
+		return nil, err
+	}
+	if p.deny, err = parsePatterns(deny, true); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Allowed reports whether the origin URL passes the policy.
+func (p *OriginPolicy) Allowed(u *url.URL) bool {
+	if p == nil {
+		return true
+	}
+	for _, d := range p.deny {
+		if d.match(u) {
+			return false
+		}
+	}
+	if len(p.allow) == 0 {
+		return true
+	}
+	for _, a := range p.allow {
+		if a.match(u) {
+			return true
+		}
+	}
+	return false
+}
+
+// Listed reports whether an allow pattern matches the origin URL, unlike
+// Allowed it is false for every origin when the allow list is empty.
+func (p *OriginPolicy) Listed(u *url.URL) bool {
+	if p == nil {
+		return false
+	}
+	for _, a := range p.allow {
+		if a.match(u) {
+			return true
+		}
+	}
+	return false
+}
+
+// ListedHost reports whether an allow pattern matches the host under whatever
+// path prefix. The scheme is unknown, so a host without a port is taken for
+// one on the default port.
+func (p *OriginPolicy) ListedHost(host string) bool {
+	if p == nil {
+		return false
+	}
+	u := &url.URL{Host: host}
+	for _, a := range p.allow {
+		if a.matchHost(u) {
+			return true
+		}
+	}
+	return false
+}
+
+func parsePatterns(raw []string, anyPort bool) ([]pattern, error) {
+	patterns := make([]pattern, 0, len(raw))
+	for _, r := range raw {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		p, err := parsePattern(r)
+		if err != nil {
+			return nil, err
+		}
+		p.anyPort = anyPort
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+func parsePattern(raw string) (pattern, error) {
+	host, prefix := raw, ""
+	if i := strings.Index(raw, "/"); i >= 0 {
+		host, prefix = raw[:i], strings.TrimSuffix(path.Clean(raw[i:]), "/")
+	}
+	p := pattern{host: strings.ToLower(host), prefix: prefix}
+	// Parsing as a URL host splits the port off, brackets of IPv6 addresses included.
+	if u, err := url.Parse("//" + p.host); err == nil && u.Port() != "" {
+		p.host, p.port = u.Hostname(), u.Port()
+	} else if strings.HasSuffix(p.host, ":") {
+		return pattern{}, errors.Errorf("invalid origin pattern %q", raw)
+	}
+	if strings.HasPrefix(p.host, "*.") {
+		p.wildcard = true
+		p.host = p.host[1:]
+	}
+	if p.host == "" || p.host == "." || strings.ContainsAny(p.host, "*:") {
+		return pattern{}, errors.Errorf("invalid origin pattern %q", raw)
+	}
+	return p, nil
+}
+
+func (p pattern) match(u *url.URL) bool {
+	if !p.matchHost(u) {
+		return false
+	}
+	if p.prefix == "" {
+		return true
+	}
+	urlPath := path.Clean("/" + u.Path)
+	return urlPath == p.prefix || strings.HasPrefix(urlPath, p.prefix+"/")
+}
+
+func (p pattern) matchHost(u *url.URL) bool {
+	host := strings.ToLower(u.Hostname())
+	if p.wildcard {
+		if !strings.HasSuffix(host, p.host) {
+			return false
+		}
+	} else if host != p.host {
+		return false
+	}
+	port := u.Port()
+	if port == "" {
+		port = defaultPort(u.Scheme)
+	}
+	switch {
+	case p.port != "":
+		return port == p.port
+	case p.anyPort:
+		return true
+	default:
+		return port == defaultPort(u.Scheme)
+	}
+}
+
+func defaultPort(scheme string) string {
+	switch scheme {
+	case "http":
+		return "80"
+	case "https":
+		return "443"
+	default:
+		return ""
+	}
+}
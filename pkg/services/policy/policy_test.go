@@ -0,0 +1,73 @@
+package policy
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func mustParse(t *testing.T, raw string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(raw)
+	require.NoError(t, err)
+	return u
+}
+
+func TestOriginPolicy(t *testing.T) {
+	p, err := NewOriginPolicy(
+		[]string{"example.com", "*.cdn.example.com", "media.partner.org/images/", "nginx:80"},
+		[]string{"private.cdn.example.com", "example.com/admin"},
+	)
+	require.NoError(t, err)
+
+	tests := []struct {
+		url     string
+		allowed bool
+	}{
+		{"http://example.com/a.jpg", true},
+		{"http://EXAMPLE.com:80/a.jpg", true},
+		{"https://example.com/a.jpg", true},
+		{"http://example.com:8080/a.jpg", false},
+		{"http://example.com:6379/a.jpg", false},
+		{"http://example.com/admin/a.jpg", false},
+		{"http://example.com/administrator.jpg", true},
+		{"http://img.cdn.example.com/a.jpg", true},
+		{"http://cdn.example.com/a.jpg", false},
+		{"http://private.cdn.example.com/a.jpg", false},
+		{"http://evilexample.com/a.jpg", false},
+		{"http://media.partner.org/images/a.jpg", true},
+		{"http://media.partner.org/images/../secret.jpg", false},
+		{"http://media.partner.org/imagesx.jpg", false},
+		{"http://nginx:80/a.jpg", true},
+		{"http://nginx:8080/a.jpg", false},
+		{"http://nginx/a.jpg", true},
+		{"https://nginx/a.jpg", false},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.allowed, p.Allowed(mustParse(t, tt.url)), tt.url)
+	}
+	require.True(t, p.ListedHost("media.partner.org"), "listed under a path prefix")
+	require.True(t, p.ListedHost("img.cdn.example.com"))
+	require.False(t, p.ListedHost("evilexample.com"))
+}
+
+func TestOriginPolicyDenyOnly(t *testing.T) {
+	p, err := NewOriginPolicy(nil, []string{"*.internal"})
+	require.NoError(t, err)
+	require.True(t, p.Allowed(mustParse(t, "http://example.com/a.jpg")))
+	require.False(t, p.Allowed(mustParse(t, "http://db.internal/a.jpg")))
+	require.False(t, p.Allowed(mustParse(t, "http://db.internal:6379/a.jpg")), "deny pattern covers every port")
+	require.False(t, p.Listed(mustParse(t, "http://example.com/a.jpg")), "allowed but not listed")
+	require.False(t, p.ListedHost("example.com"))
+
+	var empty *OriginPolicy
+	require.True(t, empty.Allowed(mustParse(t, "http://db.internal/a.jpg")))
+}
+
+func TestOriginPolicyInvalid(t *testing.T) {
+	for _, raw := range []string{"*", "foo.*.com", "/images", "example.com:", "example.com:http"} {
+		_, err := NewOriginPolicy([]string{raw}, nil)
+		require.Error(t, err, raw)
+	}
+}
@@ -0,0 +1,48 @@
+package processor
+
+import (
+	"context"
+	"time"
+
+	"github.com/bestleg/ImagePreviewer/pkg/utils"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/semaphore"
+)
+
+// memoryBudget admits transformations while the memory they are estimated
+// to allocate together fits into the configured size.
+type memoryBudget struct {
+	size int64
+	wait time.Duration
+	sem  *semaphore.Weighted
+}
+
+func newMemoryBudget(size int64, wait time.Duration) *memoryBudget {
+	if size <= 0 {
+		return nil
+	}
+	return &memoryBudget{size: size, wait: wait, sem: semaphore.NewWeighted(size)}
+}
+
+// acquire waits until n bytes of the budget are free, the returned function gives them back.
+func (b *memoryBudget) acquire(ctx context.Context, n int64) (func(), error) {
+	if b == nil {
+		return func() {}, nil
+	}
+	if n > b.size {
+		return nil, errors.Wrapf(utils.ErrSourceTooLarge, "transformation needs %d bytes, memory budget is %d", n, b.size)
+	}
+	waitCtx := ctx
+	if b.wait > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, b.wait)
+		defer cancel()
+	}
+	if err := b.sem.Acquire(waitCtx, n); err != nil {
+		if ctx.Err() != nil {
+			return nil, errors.Wrap(ctx.Err(), "waiting for memory budget")
+		}
+		return nil, errors.Wrapf(utils.ErrOverloaded, "no %d bytes of memory budget in %s", n, b.wait)
+	}
+	return func() { b.sem.Release(n) }, nil
+}
@@ -0,0 +1,36 @@
+package processor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bestleg/ImagePreviewer/pkg/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	b := newMemoryBudget(100, 10*time.Millisecond)
+	ctx := context.Background()
+
+	release, err := b.acquire(ctx, 60)
+	require.NoError(t, err)
+
+	_, err = b.acquire(ctx, 50)
+	require.ErrorIs(t, err, utils.ErrOverloaded, "budget is exhausted")
+
+	_, err = b.acquire(ctx, 101)
+	require.ErrorIs(t, err, utils.ErrSourceTooLarge, "job exceeds the whole budget")
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = b.acquire(canceled, 50)
+	require.ErrorIs(t, err, context.Canceled)
+
+	release()
+	release, err = b.acquire(ctx, 100)
+	require.NoError(t, err)
+	release()
+
+	require.Nil(t, newMemoryBudget(0, time.Second), "no budget configured")
+}
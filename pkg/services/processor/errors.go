@@ -0,0 +1,119 @@
+package processor
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/bestleg/ImagePreviewer/pkg/logging"
+	"github.com/bestleg/ImagePreviewer/pkg/utils"
+	"github.com/pkg/errors"
+)
+
+const (
+	codeBadRequest             = "bad_request"
+	codeInvalidSignature       = "invalid_signature"
+	codeUnknownPreset          = "unknown_preset"
+	codePresetRequired         = "preset_required"
+	codeOriginNotAllowed       = "origin_not_allowed"
+	codeOriginNotFound         = "origin_not_found"
+	codeOriginForbidden        = "origin_forbidden"
+	codeOriginBadStatus        = "origin_bad_status"
+	codeUnsupportedContentType = "unsupported_content_type"
+	codeSourceTooLarge         = "source_too_large"
+	codeImageTooLarge          = "image_too_large"
+	codeDecodeFailed           = "decode_failed"
+	codeOriginTimeout          = "origin_timeout"
+	codeTooManyRedirects       = "too_many_redirects"
+	codeOriginUnavailable      = "origin_unavailable"
+	codeOriginBusy             = "origin_busy"
+	codeProcessingTimeout      = "processing_timeout"
+	codeOverloaded             = "overloaded"
+	codeEncodeFailed           = "encode_failed"
+	codeBadGateway             = "bad_gateway"
+)
+
+// retryAfterSeconds is suggested to clients on 503 responses, all of them
+// are caused by short overloads of the service or an origin.
+const retryAfterSeconds = 1
+
+type errorKind struct {
+	err    error
+	status int
+	code   string
+}
+
+// errorKinds lists known pipeline errors, the first match wins.
+var errorKinds = []errorKind{
+	{utils.ErrNotSupportedScheme, http.StatusBadRequest, codeBadRequest},
+	{utils.ErrNotSupportedCropFormat, http.StatusBadRequest, codeBadRequest},
+	{utils.ErrInvalidSize, http.StatusBadRequest, codeBadRequest},
+	{utils.ErrUnknownPreset, http.StatusNotFound, codeUnknownPreset},
+	{utils.ErrPresetRequired, http.StatusBadRequest, codePresetRequired},
+	{utils.ErrFailedToParseImageURL, http.StatusBadRequest, codeBadRequest},
+	{utils.ErrFailedToCreateProxyRequest, http.StatusBadRequest, codeBadRequest},
+	{utils.ErrInvalidSignature, http.StatusForbidden, codeInvalidSignature},
+	{utils.ErrOriginNotAllowed, http.StatusForbidden, codeOriginNotAllowed},
+	{utils.ErrOriginNotFound, http.StatusNotFound, codeOriginNotFound},
+	{utils.ErrOriginForbidden, http.StatusForbidden, codeOriginForbidden},
+	{utils.ErrOriginBadStatus, http.StatusBadGateway, codeOriginBadStatus},
+	{utils.ErrNotSupportedContentType, http.StatusUnsupportedMediaType, codeUnsupportedContentType},
+	{utils.ErrSourceTooLarge, http.StatusRequestEntityTooLarge, codeSourceTooLarge},
+	{utils.ErrImageTooLarge, http.StatusUnprocessableEntity, codeImageTooLarge},
+	{utils.ErrDecodeImage, http.StatusUnprocessableEntity, codeDecodeFailed},
+	{utils.ErrOriginTimeout, http.StatusGatewayTimeout, codeOriginTimeout},
+	{utils.ErrTooManyRedirects, http.StatusBadGateway, codeTooManyRedirects},
+	{utils.ErrCircuitOpen, http.StatusServiceUnavailable, codeOriginUnavailable},
+	{utils.ErrOriginBusy, http.StatusServiceUnavailable, codeOriginBusy},
+	{utils.ErrProcessingTimeout, http.StatusGatewayTimeout, codeProcessingTimeout},
+	{utils.ErrOverloaded, http.StatusServiceUnavailable, codeOverloaded},
+	{utils.ErrEncodeImage, http.StatusInternalServerError, codeEncodeFailed},
+}
+
+// errorResponse is the JSON body returned to clients on failure.
+type errorResponse struct {
+	Code           string `json:"code"`
+	Message        string `json:"message"`
+	RequestID      string `json:"request_id,omitempty"`
+	UpstreamStatus int    `json:"upstream_status,omitempty"`
+}
+
+// classifyError maps errors of the processing pipeline to HTTP status codes.
+func classifyError(err error) (int, string) {
+	for _, k := range errorKinds {
+		if errors.Is(err, k.err) {
+			return k.status, k.code
+		}
+	}
+	return http.StatusBadGateway, codeBadGateway
+}
+
+func (p *Processor) writeError(w http.ResponseWriter, r *http.Request, status int, code string, err error) {
+	resp := errorResponse{
+		Code:      code,
+		Message:   err.Error(),
+		RequestID: logging.RequestID(r.Context()),
+	}
+	if p.hideErrorDetails {
+		resp.Message = http.StatusText(status)
+	}
+	var upstream *utils.UpstreamStatusError
+	if errors.As(err, &upstream) {
+		resp.UpstreamStatus = upstream.StatusCode
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds))
+	}
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logging.FromContext(r.Context(), p.logger).Errorf("failed to write error response: %v", err)
+	}
+}
+
+func (p *Processor) writeProcessError(w http.ResponseWriter, r *http.Request, err error) {
+	status, code := classifyError(err)
+	p.writeError(w, r, status, code, err)
+}
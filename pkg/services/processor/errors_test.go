@@ -0,0 +1,90 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bestleg/ImagePreviewer/pkg/logging"
+	"github.com/bestleg/ImagePreviewer/pkg/utils"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{errors.Wrap(utils.ErrNotSupportedScheme, "failed to fetch image"), http.StatusBadRequest, codeBadRequest},
+		{utils.WithKind(utils.ErrOriginNotFound, errors.New("404")), http.StatusNotFound, codeOriginNotFound},
+		{utils.ErrNotSupportedContentType, http.StatusUnsupportedMediaType, codeUnsupportedContentType},
+		{utils.ErrImageTooLarge, http.StatusUnprocessableEntity, codeImageTooLarge},
+		{utils.WithKind(utils.ErrDecodeImage, errors.New("bad")), http.StatusUnprocessableEntity, codeDecodeFailed},
+		{utils.ErrOriginTimeout, http.StatusGatewayTimeout, codeOriginTimeout},
+		{errors.Wrap(utils.WithKind(utils.ErrProcessingTimeout, context.DeadlineExceeded), "decode stage"),
+			http.StatusGatewayTimeout, codeProcessingTimeout},
+		{errors.Wrap(utils.ErrOverloaded, "no free worker"), http.StatusServiceUnavailable, codeOverloaded},
+		{errors.New("connection refused"), http.StatusBadGateway, codeBadGateway},
+	}
+	for _, tt := range tests {
+		status, code := classifyError(tt.err)
+		require.Equal(t, tt.status, status, tt.err.Error())
+		require.Equal(t, tt.code, code, tt.err.Error())
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	err := errors.Wrap(
+		utils.WithKind(utils.ErrOriginNotFound, &utils.UpstreamStatusError{StatusCode: http.StatusNotFound}),
+		"failed to fetch image",
+	)
+
+	t.Run("with details", func(t *testing.T) {
+		p := NewProcessor("", zap.NewNop().Sugar(), nil, nil, nil)
+		r := httptest.NewRequest(http.MethodGet, "/fill/1/1/host/img.jpg", nil)
+		r = r.WithContext(logging.WithRequestID(r.Context(), "req-1"))
+		w := httptest.NewRecorder()
+
+		p.writeProcessError(w, r, err)
+
+		require.Equal(t, http.StatusNotFound, w.Code)
+		require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		var resp errorResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.Equal(t, errorResponse{
+			Code:           codeOriginNotFound,
+			Message:        err.Error(),
+			RequestID:      "req-1",
+			UpstreamStatus: http.StatusNotFound,
+		}, resp)
+	})
+
+	t.Run("hidden details", func(t *testing.T) {
+		p := NewProcessor("", zap.NewNop().Sugar(), nil, nil, nil, WithHiddenErrorDetails(true))
+		r := httptest.NewRequest(http.MethodGet, "/fill/1/1/host/img.jpg", nil)
+		w := httptest.NewRecorder()
+
+		p.writeProcessError(w, r, err)
+
+		var resp errorResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.Equal(t, http.StatusText(http.StatusNotFound), resp.Message)
+		require.Equal(t, codeOriginNotFound, resp.Code)
+	})
+
+	t.Run("retry after", func(t *testing.T) {
+		p := NewProcessor("", zap.NewNop().Sugar(), nil, nil, nil)
+		r := httptest.NewRequest(http.MethodGet, "/fill/1/1/host/img.jpg", nil)
+		w := httptest.NewRecorder()
+
+		p.writeProcessError(w, r, utils.ErrOverloaded)
+
+		require.Equal(t, http.StatusServiceUnavailable, w.Code)
+		require.Equal(t, "1", w.Header().Get("Retry-After"))
+	})
+}
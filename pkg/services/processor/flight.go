@@ -0,0 +1,107 @@
+package processor
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	lru "github.com/bestleg/ImagePreviewer/pkg/services/cache"
+	"github.com/pkg/errors"
+)
+
+// flight is a preview being rendered on behalf of one or more requests.
+type flight struct {
+	done    chan struct{}
+	cancel  context.CancelFunc
+	waiters int
+	img     []byte
+	err     error
+}
+
+// flightGroup renders concurrent requests for the same preview once. The work
+// is canceled only when every request waiting for it has gone away.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[lru.Key]*flight
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{flights: make(map[lru.Key]*flight)}
+}
+
+func (g *flightGroup) do(
+	ctx context.Context,
+	key lru.Key,
+	render func(ctx context.Context) ([]byte, error),
+) ([]byte, error) {
+	g.mu.Lock()
+	f, ok := g.flights[key]
+	if !ok {
+		// The work must outlive the request which started it, while keeping its values.
+		workCtx, cancel := context.WithCancel(detachedContext{ctx})
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		g.flights[key] = f
+		go g.run(workCtx, key, f, render)
+	}
+	f.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.img, f.err
+	case <-ctx.Done():
+		g.leave(key, f)
+		return nil, errors.Wrap(ctx.Err(), "request abandoned")
+	}
+}
+
+func (g *flightGroup) run(
+	ctx context.Context,
+	key lru.Key,
+	f *flight,
+	render func(ctx context.Context) ([]byte, error),
+) {
+	f.img, f.err = render(ctx)
+	g.mu.Lock()
+	if g.flights[key] == f {
+		delete(g.flights, key)
+	}
+	g.mu.Unlock()
+	close(f.done)
+	f.cancel()
+}
+
+func (g *flightGroup) leave(key lru.Key, f *flight) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	f.waiters--
+	if f.waiters > 0 {
+		return
+	}
+	f.cancel()
+	// Later requests must not join the canceled work.
+	if g.flights[key] == f {
+		delete(g.flights, key)
+	}
+}
+
+// detachedContext keeps the values of its parent but not its cancellation.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
@@ -0,0 +1,93 @@
+package processor
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies spans of the processor among those of other libraries.
+const tracerName = "github.com/bestleg/ImagePreviewer/pkg/services/processor"
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "image_previewer",
+		Name:      "requests_total",
+		Help:      "Preview requests by crop mode and response status.",
+	}, []string{"mode", "status"})
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "image_previewer",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of preview requests by crop mode and response status.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+	}, []string{"mode", "status"})
+)
+
+// clientClosedRequest is reported for requests abandoned by clients before any response.
+const clientClosedRequest = 499
+
+// instrument records the count and duration of requests handled by next
+// and traces them, continuing the trace of the client if it sent one.
+func (p *Processor) instrument(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		start := time.Now()
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := p.tracer.Start(ctx, "preview", trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, r.WithContext(ctx), ps)
+
+		status := rec.status
+		if status == 0 {
+			status = clientClosedRequest
+		}
+		mode := cropModeLabel(ps.ByName("cropFormat"))
+		labels := []string{mode, strconv.Itoa(status)}
+		requestsTotal.WithLabelValues(labels...).Inc()
+		requestDuration.WithLabelValues(labels...).Observe(time.Since(start).Seconds())
+
+		span.SetAttributes(attribute.String("preview.mode", mode), attribute.Int("http.status_code", status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
+
+// cropModeLabel keeps arbitrary path segments out of metric labels.
+func cropModeLabel(cropFormat string) string {
+	switch cropFormat {
+	case "fill", "resize", presetSegment:
+		return cropFormat
+	default:
+		return "invalid"
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
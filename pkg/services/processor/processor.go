@@ -6,24 +6,101 @@ import (
 	"io/fs"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"path"
 	"strconv"
+	"time"
 
+	"github.com/bestleg/ImagePreviewer/pkg/logging"
 	lru "github.com/bestleg/ImagePreviewer/pkg/services/cache"
 	"github.com/bestleg/ImagePreviewer/pkg/services/cropper"
 	"github.com/bestleg/ImagePreviewer/pkg/services/fetcher"
+	"github.com/bestleg/ImagePreviewer/pkg/services/policy"
+	"github.com/bestleg/ImagePreviewer/pkg/services/signer"
 	"github.com/bestleg/ImagePreviewer/pkg/utils"
 	"github.com/julienschmidt/httprouter"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
 type Processor struct {
-	cacheDir string
-	logger   *zap.SugaredLogger
-	fetcher  fetcher.Fetcher
-	cropper  cropper.Transformer
-	cache    lru.Cache
+	cacheDir           string
+	logger             *zap.SugaredLogger
+	fetcher            fetcher.Fetcher
+	cropper            cropper.Transformer
+	cache              lru.Cache
+	hideErrorDetails   bool
+	maxOutputDimension int
+	originPolicy       *policy.OriginPolicy
+	signer             *signer.Signer
+	presets            map[string]cropper.Params
+	presetsOnly        bool
+	flights            *flightGroup
+	memory             *memoryBudget
+	tracer             trace.Tracer
+}
+
+// presetSegment is the first path segment of requests by preset name.
+const presetSegment = "preset"
+
+// Option configures optional Processor behavior.
+type Option func(*Processor)
+
+// WithHiddenErrorDetails replaces internal error messages in responses
+// with the generic status text, so that clients don't see pipeline details.
+func WithHiddenErrorDetails(hide bool) Option {
+	return func(p *Processor) {
+		p.hideErrorDetails = hide
+	}
+}
+
+// WithMaxOutputDimension limits each side of the requested preview, zero disables the limit.
+func WithMaxOutputDimension(dimension int) Option {
+	return func(p *Processor) {
+		p.maxOutputDimension = dimension
+	}
+}
+
+// WithOriginPolicy restricts origins images may be fetched from.
+func WithOriginPolicy(op *policy.OriginPolicy) Option {
+	return func(p *Processor) {
+		p.originPolicy = op
+	}
+}
+
+// WithSigner requires every preview path to be prefixed with a valid signature segment.
+func WithSigner(s *signer.Signer) Option {
+	return func(p *Processor) {
+		p.signer = s
+	}
+}
+
+// WithPresets serves /preset/<name>/<url> requests, with presetsOnly
+// the explicit /<cropFormat>/<width>/<height>/<url> form is rejected.
+func WithPresets(presets map[string]cropper.Params, presetsOnly bool) Option {
+	return func(p *Processor) {
+		p.presets = presets
+		p.presetsOnly = presetsOnly
+	}
+}
+
+// WithMemoryBudget limits the memory all transformations are estimated to use
+// together to size bytes, a job waits at most wait for its share. Zero size disables the limit.
+func WithMemoryBudget(size int64, wait time.Duration) Option {
+	return func(p *Processor) {
+		p.memory = newMemoryBudget(size, wait)
+	}
+}
+
+// WithTracerProvider traces requests with tp instead of the global provider.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(p *Processor) {
+		p.tracer = tp.Tracer(tracerName)
+	}
 }
 
 func NewProcessor(
@@ -32,100 +109,218 @@ func NewProcessor(
 	f fetcher.Fetcher,
 	t cropper.Transformer,
 	c lru.Cache,
+	opts ...Option,
 ) *Processor {
-	return &Processor{cacheDir: cacheDir, logger: l, fetcher: f, cropper: t, cache: c}
+	p := &Processor{
+		cacheDir: cacheDir,
+		logger:   l,
+		fetcher:  f,
+		cropper:  t,
+		cache:    c,
+		flights:  newFlightGroup(),
+		tracer:   otel.Tracer(tracerName),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
 }
 
-func (p *Processor) ProcessorHandler(ctx context.Context) http.Handler {
+func (p *Processor) ProcessorHandler() http.Handler {
 	r := httprouter.New()
-	crop := uint8(0)
-	r.GET("/:cropFormat/:width/:height/*url", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-		cropFormat := ps.ByName("cropFormat")
-		rawWidth := ps.ByName("width")
-		rawHeight := ps.ByName("height")
-		url := ps.ByName("url")
-		url = "http://" + url[1:]
-		p.logger.Infow("app request",
-			"url", url,
-			"width", rawWidth,
-			"height", rawHeight,
-			"headers", r.Header,
-		)
-		switch cropFormat {
-		case "fill":
-			crop = utils.Fill
-		case "resize":
-			crop = utils.Resize
-		default:
-			{
-				p.logger.Errorf("wrong type of crop image: %s", cropFormat)
-				http.Error(w, fmt.Sprintf("wrong type of crop image: %s", cropFormat), http.StatusBadRequest)
-				return
-			}
-		}
-		width, err := strconv.Atoi(rawWidth)
+	handle := func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		logger := logging.FromContext(r.Context(), p.logger)
+		url, params, err := p.parseRequest(ps)
 		if err != nil {
-			p.logger.Errorf("failed to parse width: %v", err)
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			logger.Errorf("failed to parse request: %v", err)
+			p.writeProcessError(w, r, err)
 			return
 		}
-		height, err := strconv.Atoi(rawHeight)
-		if err != nil {
-			p.logger.Errorf("failed to parse height: %v", err)
-			http.Error(w, err.Error(), http.StatusBadRequest)
+		logger.Infow("app request",
+			"url", url,
+			"width", params.Width,
+			"height", params.Height,
+			"headers", r.Header,
+		)
+
+		img, err := p.process(r.Context(), url, r.Header, params)
+		if err != nil && r.Context().Err() != nil {
+			logger.Infof("client canceled request: %v", err)
 			return
 		}
-
-		img, err := p.process(ctx, url, r.Header, width, height, crop)
 		if err != nil {
-			p.logger.Errorf("failed to handle request: %v", err)
-			http.Error(w, err.Error(), http.StatusBadGateway)
+			logger.Errorf("failed to handle request: %v", err)
+			p.writeProcessError(w, r, err)
 			return
 		}
 
-		w.Header().Add("Content-Type", "image/jpeg")
+		w.Header().Add("Content-Type", params.ContentType())
 		w.Header().Set("Content-Length", strconv.Itoa(len(img)))
 
 		if _, err := w.Write(img); err != nil {
-			p.logger.Errorf("failed to write response: %v", err)
+			logger.Errorf("failed to write response: %v", err)
 		}
-	})
+	}
+	if p.signer == nil {
+		r.GET("/:cropFormat/:width/:height/*url", p.instrument(handle))
+	} else {
+		r.GET("/:signature/:cropFormat/:width/:height/*url", p.instrument(p.verifySignature(handle)))
+	}
 	return r
 }
 
+// verifySignature rejects requests whose signature segment doesn't match the rest of the path.
+func (p *Processor) verifySignature(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		signedPath := ps.ByName("cropFormat") + "/" + ps.ByName("width") + "/" + ps.ByName("height") + ps.ByName("url")
+		if !p.signer.Verify(signedPath, ps.ByName("signature")) {
+			err := errors.Wrapf(utils.ErrInvalidSignature, "path %s", signedPath)
+			logging.FromContext(r.Context(), p.logger).Errorf("failed to handle request: %v", err)
+			p.writeError(w, r, http.StatusForbidden, codeInvalidSignature, err)
+			return
+		}
+		next(w, r, ps)
+	}
+}
+
+// parseRequest reads the origin URL and preview parameters from the path.
+// Preset paths /preset/<name>/<url> are served by the same route, so the
+// preset name comes in the width segment and the origin host in the height one.
+func (p *Processor) parseRequest(ps httprouter.Params) (string, cropper.Params, error) {
+	cropFormat := ps.ByName("cropFormat")
+	if cropFormat == presetSegment {
+		name := ps.ByName("width")
+		params, ok := p.presets[name]
+		if !ok {
+			return "", cropper.Params{}, errors.Wrapf(utils.ErrUnknownPreset, "preset %q", name)
+		}
+		return "http://" + ps.ByName("height") + ps.ByName("url"), params, nil
+	}
+	if p.presetsOnly {
+		return "", cropper.Params{}, errors.Wrapf(utils.ErrPresetRequired, "crop format %s", cropFormat)
+	}
+
+	width, err := strconv.Atoi(ps.ByName("width"))
+	if err != nil {
+		return "", cropper.Params{}, utils.WithKind(utils.ErrInvalidSize, errors.Wrap(err, "failed to parse width"))
+	}
+	height, err := strconv.Atoi(ps.ByName("height"))
+	if err != nil {
+		return "", cropper.Params{}, utils.WithKind(utils.ErrInvalidSize, errors.Wrap(err, "failed to parse height"))
+	}
+	if p.maxOutputDimension > 0 && (width > p.maxOutputDimension || height > p.maxOutputDimension) {
+		return "", cropper.Params{}, errors.Wrapf(utils.ErrImageTooLarge, "requested size %dx%d exceeds %d pixels per side",
+			width, height, p.maxOutputDimension)
+	}
+	params, err := cropper.NewParams(cropFormat, width, height, "", 0, nil)
+	if err != nil {
+		return "", cropper.Params{}, err
+	}
+	return "http://" + ps.ByName("url")[1:], params, nil
+}
+
 func (p *Processor) process(
 	ctx context.Context,
 	url string,
 	header http.Header,
-	width, height int,
-	cropFormat uint8,
+	params cropper.Params,
 ) ([]byte, error) {
-	cacheKey, err := utils.GetHash(fmt.Sprintf("%s|%d|%d|%d", url, width, height, cropFormat))
+	if err := p.checkOrigin(url); err != nil {
+		return nil, err
+	}
+	cacheKey, err := getCacheKey(url, params)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to get cacheKey hash")
+		return nil, err
 	}
-	if imgPath, found := p.cache.Get(cacheKey); found {
+	_, span := p.tracer.Start(ctx, "cache.get")
+	imgPath, found := p.cache.Get(cacheKey)
+	span.SetAttributes(attribute.Bool("cache.hit", found))
+	span.End()
+	if found {
 		img, err := ioutil.ReadFile(imgPath.(string))
 		return img, err
 	}
+	return p.flights.do(ctx, cacheKey, func(ctx context.Context) ([]byte, error) {
+		return p.render(ctx, cacheKey, url, header, params)
+	})
+}
 
-	img, err := p.fetcher.Fetch(ctx, url, header)
+// render fetches the origin image, crops it and caches the preview.
+func (p *Processor) render(
+	ctx context.Context,
+	cacheKey lru.Key,
+	url string,
+	header http.Header,
+	params cropper.Params,
+) ([]byte, error) {
+	source, err := p.fetcher.Fetch(ctx, url, header)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to fetch image")
 	}
+	if source.Redirects > 0 {
+		logging.FromContext(ctx, p.logger).Infow("origin redirected", "url", url, "final_url", source.URL)
+	}
 
-	img, err = p.cropper.Crop(img, width, height, cropFormat)
+	release, err := p.admit(ctx, source.Data, params)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to admit transformation")
+	}
+	img, err := p.cropper.Crop(ctx, source.Data, params)
+	release()
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to crop image")
 	}
 
-	imgPath := path.Join(p.cacheDir, string(cacheKey)+".jpeg")
+	_, span := p.tracer.Start(ctx, "cache.write")
+	defer span.End()
+	imgPath := path.Join(p.cacheDir, string(cacheKey)+params.Extension())
 	err = ioutil.WriteFile(imgPath, img, fs.FileMode(utils.WritePerm))
 	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 		return nil, errors.Wrap(err, "failed to save image")
 	}
 
 	p.cache.Set(cacheKey, imgPath)
+	// Requests for the final URL of a redirect share the same preview.
+	if source.Redirects > 0 {
+		finalKey, err := getCacheKey(source.URL, params)
+		if err != nil {
+			return nil, err
+		}
+		p.cache.Set(finalKey, imgPath)
+	}
 
 	return img, nil
 }
+
+// admit reserves the memory the transformation of source is estimated to need.
+func (p *Processor) admit(ctx context.Context, source []byte, params cropper.Params) (func(), error) {
+	if p.memory == nil {
+		return func() {}, nil
+	}
+	need, err := cropper.EstimateMemory(source, params, p.maxOutputDimension)
+	if err != nil {
+		return nil, err
+	}
+	return p.memory.acquire(ctx, need)
+}
+
+func getCacheKey(url string, params cropper.Params) (lru.Key, error) {
+	cacheKey, err := utils.GetHash(fmt.Sprintf("%s|%+v", url, params))
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get cacheKey hash")
+	}
+	return cacheKey, nil
+}
+
+func (p *Processor) checkOrigin(rawURL string) error {
+	originURL, err := url.Parse(rawURL)
+	if err != nil {
+		return utils.WithKind(utils.ErrFailedToParseImageURL, err)
+	}
+	if !p.originPolicy.Allowed(originURL) {
+		return errors.Wrapf(utils.ErrOriginNotAllowed, "origin %s%s", originURL.Host, originURL.Path)
+	}
+	return nil
+}
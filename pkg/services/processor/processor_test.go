@@ -0,0 +1,302 @@
+package processor
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	lru "github.com/bestleg/ImagePreviewer/pkg/services/cache"
+	"github.com/bestleg/ImagePreviewer/pkg/services/cropper"
+	"github.com/bestleg/ImagePreviewer/pkg/services/fetcher"
+	"github.com/bestleg/ImagePreviewer/pkg/services/signer"
+	"github.com/bestleg/ImagePreviewer/pkg/utils"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/zap"
+)
+
+type notFoundFetcher struct{}
+
+func (notFoundFetcher) Fetch(context.Context, string, http.Header) (*fetcher.Image, error) {
+	return nil, utils.ErrOriginNotFound
+}
+
+func TestSignedRequests(t *testing.T) {
+	s, err := signer.NewSigner([]string{"0a0b0c"})
+	require.NoError(t, err)
+	p := NewProcessor(t.TempDir(), zap.NewNop().Sugar(), notFoundFetcher{}, nil, lru.NewCache(1), WithSigner(s))
+	handler := p.ProcessorHandler()
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+	}{
+		{"signed", s.SignedPath("fill", 300, 200, "example.com/img.jpg"), http.StatusNotFound},
+		{"unsigned", "/fill/300/200/example.com/img.jpg", http.StatusForbidden},
+		{"bad signature", "/AAAA/fill/300/200/example.com/img.jpg", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		require.Equal(t, tt.status, w.Code, tt.name)
+	}
+}
+
+type recordingFetcher struct {
+	urls []string
+}
+
+func (f *recordingFetcher) Fetch(_ context.Context, url string, _ http.Header) (*fetcher.Image, error) {
+	f.urls = append(f.urls, url)
+	return nil, utils.ErrOriginNotFound
+}
+
+func TestSignedPresetRequests(t *testing.T) {
+	s, err := signer.NewSigner([]string{"0a0b0c"})
+	require.NoError(t, err)
+	thumbnail, err := cropper.NewParams("fill", 300, 200, "", 0, nil)
+	require.NoError(t, err)
+	presets := map[string]cropper.Params{"thumbnail": thumbnail, "avatar": thumbnail}
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		url    string
+	}{
+		{"signed", s.SignedPresetPath("thumbnail", "example.com/img.jpg"), http.StatusNotFound, "http://example.com/img.jpg"},
+		{"unsigned", "/preset/thumbnail/example.com/images/img.jpg", http.StatusForbidden, ""},
+		{"other preset", "/" + s.Sign("preset/thumbnail/example.com/img.jpg") + "/preset/avatar/example.com/img.jpg",
+			http.StatusForbidden, ""},
+	}
+	for _, tt := range tests {
+		f := &recordingFetcher{}
+		p := NewProcessor(t.TempDir(), zap.NewNop().Sugar(), f, nil, lru.NewCache(1),
+			WithSigner(s), WithPresets(presets, true))
+
+		w := httptest.NewRecorder()
+		p.ProcessorHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		require.Equal(t, tt.status, w.Code, tt.name)
+		if tt.url == "" {
+			require.Empty(t, f.urls, tt.name)
+		} else {
+			require.Equal(t, []string{tt.url}, f.urls, tt.name)
+		}
+	}
+}
+
+func TestPresets(t *testing.T) {
+	thumbnail, err := cropper.NewParams("fill", 300, 200, "", 0, nil)
+	require.NoError(t, err)
+	presets := map[string]cropper.Params{"thumbnail": thumbnail}
+
+	tests := []struct {
+		name        string
+		presetsOnly bool
+		path        string
+		status      int
+		url         string
+	}{
+		{"preset", false, "/preset/thumbnail/example.com/img.jpg", http.StatusNotFound, "http://example.com/img.jpg"},
+		{"unknown preset", false, "/preset/huge/example.com/img.jpg", http.StatusNotFound, ""},
+		{"explicit size", false, "/fill/10/10/example.com/img.jpg", http.StatusNotFound, "http://example.com/img.jpg"},
+		{"presets only", true, "/fill/10/10/example.com/img.jpg", http.StatusBadRequest, ""},
+		{"presets only preset", true, "/preset/thumbnail/example.com/img.jpg", http.StatusNotFound, "http://example.com/img.jpg"},
+	}
+	for _, tt := range tests {
+		f := &recordingFetcher{}
+		p := NewProcessor(t.TempDir(), zap.NewNop().Sugar(), f, nil, lru.NewCache(1),
+			WithPresets(presets, tt.presetsOnly))
+
+		w := httptest.NewRecorder()
+		p.ProcessorHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		require.Equal(t, tt.status, w.Code, tt.name)
+		if tt.url == "" {
+			require.Empty(t, f.urls, tt.name)
+		} else {
+			require.Equal(t, []string{tt.url}, f.urls, tt.name)
+		}
+	}
+}
+
+type blockingFetcher struct {
+	calls    int32
+	started  chan struct{}
+	release  chan struct{}
+	canceled chan struct{}
+}
+
+func newBlockingFetcher() *blockingFetcher {
+	return &blockingFetcher{
+		started:  make(chan struct{}, 1),
+		release:  make(chan struct{}),
+		canceled: make(chan struct{}),
+	}
+}
+
+func (f *blockingFetcher) Fetch(ctx context.Context, url string, _ http.Header) (*fetcher.Image, error) {
+	atomic.AddInt32(&f.calls, 1)
+	f.started <- struct{}{}
+	select {
+	case <-f.release:
+		return &fetcher.Image{Data: []byte("source"), URL: url}, nil
+	case <-ctx.Done():
+		close(f.canceled)
+		return nil, ctx.Err()
+	}
+}
+
+type stubCropper struct{}
+
+func (stubCropper) Crop(context.Context, []byte, cropper.Params) ([]byte, error) {
+	return []byte("preview"), nil
+}
+
+type redirectedFetcher struct {
+	finalURL  string
+	redirects int
+}
+
+func (f redirectedFetcher) Fetch(context.Context, string, http.Header) (*fetcher.Image, error) {
+	return &fetcher.Image{Data: []byte("source"), URL: f.finalURL, Redirects: f.redirects}, nil
+}
+
+func TestRedirectedSourceCacheKeys(t *testing.T) {
+	params, err := cropper.NewParams("fill", 10, 10, "", 0, nil)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		fetcher  redirectedFetcher
+		finalKey bool
+	}{
+		{"redirected", redirectedFetcher{"http://cdn.example.com/img.jpg", 1}, true},
+		{"re-escaped", redirectedFetcher{"http://example.com/my%20img.jpg", 0}, false},
+	}
+	for _, tt := range tests {
+		cache := lru.NewCache(4)
+		p := NewProcessor(t.TempDir(), zap.NewNop().Sugar(), tt.fetcher, stubCropper{}, cache)
+		w := httptest.NewRecorder()
+		p.ProcessorHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/fill/10/10/example.com/my%20img.jpg", nil))
+		require.Equal(t, http.StatusOK, w.Code, tt.name)
+
+		key, err := getCacheKey(tt.fetcher.finalURL, params)
+		require.NoError(t, err)
+		_, ok := cache.Get(key)
+		require.Equal(t, tt.finalKey, ok, tt.name)
+	}
+}
+
+func (p *Processor) waiters(key lru.Key) int {
+	p.flights.mu.Lock()
+	defer p.flights.mu.Unlock()
+	if f, ok := p.flights.flights[key]; ok {
+		return f.waiters
+	}
+	return 0
+}
+
+func TestConcurrentRequestsShareRendering(t *testing.T) {
+	f := newBlockingFetcher()
+	p := NewProcessor(t.TempDir(), zap.NewNop().Sugar(), f, stubCropper{}, lru.NewCache(1))
+	handler := p.ProcessorHandler()
+	params, err := cropper.NewParams("fill", 10, 10, "", 0, nil)
+	require.NoError(t, err)
+	key, err := getCacheKey("http://example.com/img.jpg", params)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	responses := make([]*httptest.ResponseRecorder, 2)
+	for i := range responses {
+		responses[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(w *httptest.ResponseRecorder) {
+			defer wg.Done()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/fill/10/10/example.com/img.jpg", nil))
+		}(responses[i])
+	}
+	require.Eventually(t, func() bool { return p.waiters(key) == 2 }, time.Second, time.Millisecond)
+	close(f.release)
+	wg.Wait()
+
+	require.Equal(t, int32(1), atomic.LoadInt32(&f.calls))
+	for _, w := range responses {
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "preview", w.Body.String())
+	}
+}
+
+func TestAbandonedRequestCancelsRendering(t *testing.T) {
+	f := newBlockingFetcher()
+	p := NewProcessor(t.TempDir(), zap.NewNop().Sugar(), f, stubCropper{}, lru.NewCache(1))
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest(http.MethodGet, "/fill/10/10/example.com/img.jpg", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.ProcessorHandler().ServeHTTP(w, r)
+	}()
+	<-f.started
+	cancel()
+
+	select {
+	case <-f.canceled:
+	case <-time.After(time.Second):
+		t.Fatal("fetch was not canceled")
+	}
+	<-done
+	require.Empty(t, w.Body.String())
+}
+
+func TestRequestMetrics(t *testing.T) {
+	p := NewProcessor(t.TempDir(), zap.NewNop().Sugar(), notFoundFetcher{}, nil, lru.NewCache(1))
+	handler := p.ProcessorHandler()
+
+	tests := []struct {
+		path   string
+		mode   string
+		status string
+	}{
+		{"/fill/300/200/example.com/img.jpg", "fill", "404"},
+		{"/stretch/300/200/example.com/img.jpg", "invalid", "400"},
+	}
+	for _, tt := range tests {
+		counter := requestsTotal.WithLabelValues(tt.mode, tt.status)
+		before := testutil.ToFloat64(counter)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tt.path, nil))
+		require.Equal(t, before+1, testutil.ToFloat64(counter), tt.path)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	f := newBlockingFetcher()
+	close(f.release)
+	p := NewProcessor(t.TempDir(), zap.NewNop().Sugar(), f, stubCropper{}, lru.NewCache(1), WithTracerProvider(tp))
+	w := httptest.NewRecorder()
+	p.ProcessorHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/fill/10/10/example.com/img.jpg", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, s := range recorder.Ended() {
+		spans[s.Name()] = s
+	}
+	require.Contains(t, spans, "preview")
+	root := spans["preview"].SpanContext()
+	for _, name := range []string{"cache.get", "cache.write"} {
+		require.Contains(t, spans, name)
+		require.Equal(t, root.TraceID(), spans[name].SpanContext().TraceID(), name)
+		require.Equal(t, root.SpanID(), spans[name].Parent().SpanID(), name)
+	}
+}
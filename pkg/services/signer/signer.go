@@ -0,0 +1,77 @@
+package signer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Signer signs and verifies preview paths with HMAC-SHA256. The first key
+// signs new paths, any of the keys is accepted on verification, so keys can
+// be rotated by prepending a new one and dropping the old one later.
+type Signer struct {
+	keys [][]byte
+}
+
+// NewSigner creates a Signer from hex encoded keys.
+func NewSigner(hexKeys []string) (*Signer, error) {
+	if len(hexKeys) == 0 {
+		return nil, errors.New("no signing keys")
+	}
+	s := &Signer{keys: make([][]byte, 0, len(hexKeys))}
+	for i, hexKey := range hexKeys {
+		key, err := hex.DecodeString(strings.TrimSpace(hexKey))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid signing key #%d", i)
+		}
+		if len(key) == 0 {
+			return nil, errors.Errorf("empty signing key #%d", i)
+		}
+		s.keys = append(s.keys, key)
+	}
+	return s, nil
+}
+
+// Sign returns the signature of the path "cropFormat/width/height/url" with the primary key.
+func (s *Signer) Sign(path string) string {
+	return base64.RawURLEncoding.EncodeToString(sign(s.keys[0], path))
+}
+
+// Verify reports whether signature matches the path for any of the keys.
+func (s *Signer) Verify(path, signature string) bool {
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	for _, key := range s.keys {
+		if hmac.Equal(mac, sign(key, path)) {
+			return true
+		}
+	}
+	return false
+}
+
+// SignedPath builds a signed preview path, url is the origin image address without scheme,
+// e.g. SignedPath("fill", 300, 200, "example.com/img.jpg") returns "/<signature>/fill/300/200/example.com/img.jpg".
+func (s *Signer) SignedPath(cropFormat string, width, height int, url string) string {
+	path := cropFormat + "/" + strconv.Itoa(width) + "/" + strconv.Itoa(height) + "/" + strings.TrimPrefix(url, "/")
+	return "/" + s.Sign(path) + "/" + path
+}
+
+// SignedPresetPath builds a signed path of a named preset, e.g. SignedPresetPath("thumbnail",
+// "example.com/img.jpg") returns "/<signature>/preset/thumbnail/example.com/img.jpg".
+func (s *Signer) SignedPresetPath(name, url string) string {
+	path := "preset/" + name + "/" + strings.TrimPrefix(url, "/")
+	return "/" + s.Sign(path) + "/" + path
+}
+
+func sign(key []byte, path string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(path))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,52 @@
+package signer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSigner(t *testing.T) {
+	oldSigner, err := NewSigner([]string{"0102"})
+	require.NoError(t, err)
+	rotated, err := NewSigner([]string{"a1b2c3", "0102"})
+	require.NoError(t, err)
+
+	path := "fill/300/200/example.com/img.jpg"
+
+	t.Run("sign and verify", func(t *testing.T) {
+		sig := rotated.Sign(path)
+		require.True(t, rotated.Verify(path, sig))
+		require.False(t, rotated.Verify("fill/300/201/example.com/img.jpg", sig))
+		require.False(t, rotated.Verify(path, sig+"x"))
+		require.False(t, oldSigner.Verify(path, sig))
+	})
+
+	t.Run("rotation accepts old key", func(t *testing.T) {
+		require.True(t, rotated.Verify(path, oldSigner.Sign(path)))
+	})
+
+	t.Run("signed path", func(t *testing.T) {
+		signed := rotated.SignedPath("fill", 300, 200, "example.com/img.jpg")
+		parts := strings.SplitN(strings.TrimPrefix(signed, "/"), "/", 2)
+		require.Equal(t, path, parts[1])
+		require.True(t, rotated.Verify(parts[1], parts[0]))
+	})
+
+	t.Run("signed preset path", func(t *testing.T) {
+		signed := rotated.SignedPresetPath("thumbnail", "/example.com/img.jpg")
+		parts := strings.SplitN(strings.TrimPrefix(signed, "/"), "/", 2)
+		require.Equal(t, "preset/thumbnail/example.com/img.jpg", parts[1])
+		require.True(t, rotated.Verify(parts[1], parts[0]))
+	})
+}
+
+func TestNewSignerInvalid(t *testing.T) {
+	_, err := NewSigner(nil)
+	require.Error(t, err)
+	_, err = NewSigner([]string{"not hex"})
+	require.Error(t, err)
+	_, err = NewSigner([]string{""})
+	require.Error(t, err)
+}
@@ -1,20 +1,43 @@
 package utils
 
+import "github.com/pkg/errors"
+
 const (
 	Fill      uint8 = 0b01
 	Resize    uint8 = 0b11
 	WritePerm int   = 600
 
 	SupportedContentTypes = "image/jpeg"
-	SupportedHeader       = "HTTP/1.1"
 
-	ErrNotSupportedContentType    = "not supported content type"
-	ErrNotSupportedHeader         = "not supported header"
-	ErrNotSupportedScheme         = "not http"
-	ErrFailedToReadRequestBody    = "failed to read request body"
-	ErrFailedToPerformRequest     = "failed to perform request"
-	ErrFailedToParseImageURL      = "failed to parse image url"
-	ErrFailedToCreateProxyRequest = "failed to create proxy request"
-	ErrMakingRequest              = "error making request"
-	ErrPrepareRequest             = "failed to prepare request"
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+)
+
+var (
+	ErrNotSupportedContentType    = errors.New("not supported content type")
+	ErrNotSupportedProto          = errors.New("not supported protocol version")
+	ErrNotSupportedScheme         = errors.New("not http or https")
+	ErrNotSupportedCropFormat     = errors.New("not supported crop format")
+	ErrInvalidSize                = errors.New("invalid preview size")
+	ErrUnknownPreset              = errors.New("unknown preset")
+	ErrPresetRequired             = errors.New("only presets are allowed")
+	ErrFailedToReadRequestBody    = errors.New("failed to read request body")
+	ErrFailedToPerformRequest     = errors.New("failed to perform request")
+	ErrFailedToParseImageURL      = errors.New("failed to parse image url")
+	ErrFailedToCreateProxyRequest = errors.New("failed to create proxy request")
+	ErrInvalidSignature           = errors.New("invalid url signature")
+	ErrOriginNotAllowed           = errors.New("origin is not allowed")
+	ErrOriginNotFound             = errors.New("origin image not found")
+	ErrOriginForbidden            = errors.New("origin refused access to image")
+	ErrOriginBadStatus            = errors.New("origin responded with unexpected status")
+	ErrOriginTimeout              = errors.New("origin request timed out")
+	ErrTooManyRedirects           = errors.New("too many redirects")
+	ErrOriginBusy                 = errors.New("too many requests to origin")
+	ErrCircuitOpen                = errors.New("origin is unavailable, circuit breaker is open")
+	ErrSourceTooLarge             = errors.New("origin image is too large")
+	ErrImageTooLarge              = errors.New("image is too large")
+	ErrOverloaded                 = errors.New("too many images are being processed")
+	ErrProcessingTimeout          = errors.New("image processing timed out")
+	ErrDecodeImage                = errors.New("failed to decode image")
+	ErrEncodeImage                = errors.New("failed to encode image")
 )
@@ -0,0 +1,43 @@
+package utils
+
+import (
+	"fmt"
+	"time"
+)
+
+type kindError struct {
+	kind  error
+	cause error
+}
+
+// WithKind marks cause with one of the sentinel errors, so that callers can
+// classify it with errors.Is while keeping the original error in the chain.
+func WithKind(kind, cause error) error {
+	if cause == nil {
+		return kind
+	}
+	return &kindError{kind: kind, cause: cause}
+}
+
+func (e *kindError) Error() string {
+	return e.kind.Error() + ": " + e.cause.Error()
+}
+
+func (e *kindError) Is(target error) bool {
+	return e.kind == target //nolint:errorlint
+}
+
+func (e *kindError) Unwrap() error {
+	return e.cause
+}
+
+// UpstreamStatusError reports the status code the origin server answered with.
+type UpstreamStatusError struct {
+	StatusCode int
+	// RetryAfter is the delay requested by the origin with the Retry-After header.
+	RetryAfter time.Duration
+}
+
+func (e *UpstreamStatusError) Error() string {
+	return fmt.Sprintf("origin responded with status %d", e.StatusCode)
+}
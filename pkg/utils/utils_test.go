@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"io"
 	"testing"
 
 	"github.com/bestleg/ImagePreviewer/pkg/services/cache"
@@ -18,3 +19,13 @@ func TestGetHash(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, cache.Key("3ad351775b4634b7"), val)
 }
+
+func TestWithKind(t *testing.T) {
+	err := WithKind(ErrOriginTimeout, io.ErrUnexpectedEOF)
+	require.ErrorIs(t, err, ErrOriginTimeout)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	require.NotErrorIs(t, err, ErrOriginNotFound)
+	require.Equal(t, "origin request timed out: unexpected EOF", err.Error())
+
+	require.Equal(t, ErrDecodeImage, WithKind(ErrDecodeImage, nil))
+}